@@ -0,0 +1,187 @@
+package topkapi
+
+import (
+	"errors"
+	"math"
+	"sync/atomic"
+)
+
+// candidate is the heavy hitter candidate of a bucket in an AtomicSketch. The
+// key of a candidate never changes; a bucket is taken over by swapping in a
+// new candidate.
+type candidate struct {
+	key   string
+	count atomic.Int64
+}
+
+// AtomicSketch is a Sketch that can be updated by many goroutines without
+// locking. The count-min rows are updated with atomic adds, and each bucket's
+// heavy hitter candidate is replaced with a compare-and-swap.
+//
+// Updates racing for the same bucket may lose some of the heavy hitter
+// counter's increments when the bucket changes hands, but the count-min rows
+// are always exact, so the counts reported never underestimate.
+type AtomicSketch struct {
+	l      uint64 // number of rows
+	b      uint64 // think of this as the k
+	k      uint64 // number of heavy hitters the sketch was sized for, if known
+	cms    []uint64
+	slots  []atomic.Pointer[candidate]
+	hasher Hasher[string]
+}
+
+// NewAtomic creates an AtomicSketch configured by opts. See NewWithOptions
+// for details. Conservative updates cannot be made atomically and are not
+// supported.
+func NewAtomic(opts ...Option) (*AtomicSketch, error) {
+	o, err := newOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := o.only(0); err != nil {
+		return nil, err
+	}
+	if o.conservative {
+		return nil, errors.New("topkapi: AtomicSketch does not support conservative updates")
+	}
+	b, l, err := o.dimensions(stringSize)
+	if err != nil {
+		return nil, err
+	}
+	hasher, err := o.hasher()
+	if err != nil {
+		return nil, err
+	}
+
+	return &AtomicSketch{
+		l:      l,
+		b:      b,
+		k:      o.k,
+		cms:    make([]uint64, l*b),
+		slots:  make([]atomic.Pointer[candidate], l*b),
+		hasher: hasher,
+	}, nil
+}
+
+// Epsilon is the approximate error range factor.
+func (sk *AtomicSketch) Epsilon() float64 {
+	return 1.0 / float64(sk.b)
+}
+
+// Delta is the probability for a measurement to be outside the epsilon range
+func (sk *AtomicSketch) Delta() float64 {
+	return 2.0 / math.Exp(float64(sk.l))
+}
+
+// Insert adds count occurrences of key to the sketch. It is safe to call
+// concurrently with all other methods.
+func (sk *AtomicSketch) Insert(key string, count uint64) {
+	h1, h2 := hashes(sk.hasher.Hash(key))
+
+	for i := uint64(0); i < sk.l; i++ {
+		h := uint64((h1 + uint32(i)*h2))
+		idx := i*sk.b + h%sk.b
+
+		atomic.AddUint64(&sk.cms[idx], count)
+
+		slot := &sk.slots[idx]
+		c := slot.Load()
+		if c != nil && c.key == key {
+			c.count.Add(int64(count))
+			continue
+		}
+		rest := -int64(count)
+		if c != nil {
+			if rest = c.count.Add(-int64(count)); rest > 0 {
+				continue
+			}
+		}
+
+		// The bucket is free or its candidate has been voted out
+		n := &candidate{key: key}
+		n.count.Store(takeover(rest, count))
+		slot.CompareAndSwap(c, n)
+	}
+}
+
+// Estimate is like Sketch.Estimate.
+func (sk *AtomicSketch) Estimate(key string) (uint64, bool) {
+	var (
+		h1, h2  = hashes(sk.hasher.Hash(key))
+		min     = uint64(math.MaxUint64)
+		tracked bool
+	)
+
+	for i := uint64(0); i < sk.l; i++ {
+		h := uint64((h1 + uint32(i)*h2))
+		idx := i*sk.b + h%sk.b
+
+		if count := atomic.LoadUint64(&sk.cms[idx]); count < min {
+			min = count
+		}
+		if c := sk.slots[idx].Load(); c != nil && c.key == key && c.count.Load() > 0 {
+			tracked = true
+		}
+	}
+
+	if sk.l == 0 {
+		return 0, false
+	}
+	return min, tracked
+}
+
+// Total is like Sketch.Total. Every insert adds its count to one counter of
+// each row, so the total is the sum of any row.
+func (sk *AtomicSketch) Total() uint64 {
+	var total uint64
+	for i := uint64(0); i < sk.b && sk.l > 0; i++ {
+		total += atomic.LoadUint64(&sk.cms[i])
+	}
+	return total
+}
+
+// Snapshot returns a Sketch holding the current contents of sk, which can be
+// queried, merged and marshalled like any other Sketch. Inserts running
+// concurrently with Snapshot may or may not be included.
+func (sk *AtomicSketch) Snapshot() *Sketch {
+	tmp := &Sketch{*newGenericSketch(sk.b, sk.l, 64, sk.hasher)}
+	tmp.k = sk.k
+	tmp.total = sk.Total()
+
+	for i := range tmp.buckets {
+		bk := &tmp.buckets[i]
+		bk.cms = atomic.LoadUint64(&sk.cms[i])
+		if c := sk.slots[i].Load(); c != nil {
+			h := sk.hasher.Hash(c.key)
+			tmp.assign(&bk.keyRef, c.key, h, tmp.find(c.key, h))
+			bk.count = c.count.Load()
+		}
+	}
+
+	return tmp
+}
+
+// Result is like Sketch.Result, computed over a Snapshot.
+func (sk *AtomicSketch) Result(threshold uint64) []LocalHeavyHitter {
+	return sk.Snapshot().Result(threshold)
+}
+
+// ResultFraction is like Sketch.ResultFraction, computed over a Snapshot.
+func (sk *AtomicSketch) ResultFraction(phi float64) []LocalHeavyHitter {
+	return sk.Snapshot().ResultFraction(phi)
+}
+
+// ResultWithVotes is like Sketch.ResultWithVotes, computed over a Snapshot.
+func (sk *AtomicSketch) ResultWithVotes(threshold uint64, minVotes int) []LocalHeavyHitter {
+	return sk.Snapshot().ResultWithVotes(threshold, minVotes)
+}
+
+// TopK is like Sketch.TopK, computed over a Snapshot.
+func (sk *AtomicSketch) TopK(k int) []LocalHeavyHitter {
+	return sk.Snapshot().TopK(k)
+}
+
+// Top is like Sketch.Top, computed over a Snapshot.
+func (sk *AtomicSketch) Top() []LocalHeavyHitter {
+	return sk.Snapshot().Top()
+}
@@ -0,0 +1,91 @@
+package topkapi
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAtomicInsert(t *testing.T) {
+	words := primeWords()
+
+	sketch, _ := NewAtomic(WithK(20), WithCorpusSize(uint64(len(words))))
+
+	var wg sync.WaitGroup
+	for _, slice := range split(words, 16) {
+		wg.Add(1)
+		go func(slice []string) {
+			defer wg.Done()
+			for _, w := range slice {
+				sketch.Insert(w, 1)
+			}
+		}(slice)
+	}
+	wg.Wait()
+
+	// Without concurrent inserts the count-min rows are identical to a plain sketch
+	plain, _ := NewTopK(20, uint64(len(words)), 0.01)
+	for _, w := range words {
+		plain.Insert(w, 1)
+	}
+	assert.Equal(t, cmsOf(plain), cmsOf(sketch.Snapshot()))
+
+	exact := exactCount(words)
+	result := sketch.Result(1)
+	for i, w := range exactTop(exact)[:8] {
+		assert.Equal(t, w, result[i].Key)
+		count, tracked := sketch.Estimate(w)
+		assert.True(t, tracked)
+		assert.Equal(t, result[i].Count, count)
+	}
+	assert.Len(t, sketch.Top(), 20)
+}
+
+// mutexSketch is the baseline a caller would otherwise have to write
+type mutexSketch struct {
+	sync.Mutex
+	sk *Sketch
+}
+
+func (m *mutexSketch) Insert(key string, count uint64) {
+	m.Lock()
+	m.sk.Insert(key, count)
+	m.Unlock()
+}
+
+func benchmarkParallelInsert(b *testing.B, goroutines int, insert func(string, uint64)) {
+	words := loadWords()
+
+	b.ResetTimer()
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := g; i < b.N; i += goroutines {
+				insert(words[i%len(words)], 1)
+			}
+		}(g)
+	}
+	wg.Wait()
+}
+
+func BenchmarkParallelInsert(b *testing.B) {
+	for _, goroutines := range []int{1, 4, 16, 64} {
+		b.Run(fmt.Sprintf("mutex/%d", goroutines), func(b *testing.B) {
+			sk, _ := NewTopK(100, 100000, 0.01)
+			m := &mutexSketch{sk: sk}
+			benchmarkParallelInsert(b, goroutines, m.Insert)
+		})
+		b.Run(fmt.Sprintf("atomic/%d", goroutines), func(b *testing.B) {
+			sk, _ := NewAtomic(WithK(100), WithCorpusSize(100000))
+			benchmarkParallelInsert(b, goroutines, sk.Insert)
+		})
+		b.Run(fmt.Sprintf("sharded/%d", goroutines), func(b *testing.B) {
+			sk, _ := NewConcurrent(WithK(100), WithCorpusSize(100000))
+			benchmarkParallelInsert(b, goroutines, sk.Insert)
+		})
+	}
+}
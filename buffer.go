@@ -0,0 +1,69 @@
+package topkapi
+
+// Inserter is implemented by the sketches of this package that count
+// occurrences without a time, which is all of them but DecayedSketch, and by
+// Buffer itself.
+type Inserter[K comparable] interface {
+	Insert(key K, count uint64)
+}
+
+// Buffer pre-aggregates the counts of recently inserted keys, and inserts
+// each key into the underlying sketch once with its total count when the
+// buffer is full or flushed. On skewed streams, where the same key is
+// inserted many times in a short time, this saves most of the work of
+// inserting into the sketch.
+//
+// Count-min estimates are unaffected by buffering. Buffered keys are not
+// visible in the sketch until they are flushed. A Buffer is not safe for
+// concurrent use.
+type Buffer[K comparable] struct {
+	sk     Inserter[K]
+	size   int
+	index  map[K]int
+	keys   []K
+	counts []uint64
+}
+
+// NewBuffer creates a Buffer holding up to size distinct keys before
+// inserting them into sk.
+func NewBuffer[K comparable](sk Inserter[K], size int) *Buffer[K] {
+	if size < 1 {
+		size = 1
+	}
+	return &Buffer[K]{
+		sk:     sk,
+		size:   size,
+		index:  make(map[K]int, size),
+		keys:   make([]K, 0, size),
+		counts: make([]uint64, 0, size),
+	}
+}
+
+// Insert adds count occurrences of key to the buffer, flushing it first if
+// key is not buffered yet and the buffer is full.
+func (b *Buffer[K]) Insert(key K, count uint64) {
+	if idx, ok := b.index[key]; ok {
+		b.counts[idx] += count
+		return
+	}
+
+	if len(b.keys) >= b.size {
+		b.Flush()
+	}
+	b.index[key] = len(b.keys)
+	b.keys = append(b.keys, key)
+	b.counts = append(b.counts, count)
+}
+
+// Flush inserts all buffered keys into the sketch, in the order they were
+// first inserted into the buffer, and empties the buffer.
+func (b *Buffer[K]) Flush() {
+	var zero K
+	for i, key := range b.keys {
+		b.sk.Insert(key, b.counts[i])
+		delete(b.index, key)
+		b.keys[i] = zero
+	}
+	b.keys = b.keys[:0]
+	b.counts = b.counts[:0]
+}
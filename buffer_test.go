@@ -0,0 +1,53 @@
+package topkapi
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuffer(t *testing.T) {
+	words := primeWords()
+
+	sketch, _ := NewTopK(20, uint64(len(words)), 0.01)
+	for _, w := range words {
+		sketch.Insert(w, 1)
+	}
+
+	buffered, _ := NewTopK(20, uint64(len(words)), 0.01)
+	buf := NewBuffer[string](buffered, 64)
+	for _, w := range words {
+		buf.Insert(w, 1)
+	}
+	buf.Flush()
+
+	assert.Equal(t, cmsOf(sketch), cmsOf(buffered))
+
+	exact := exactCount(words)
+	top := buffered.Top()
+	for i, w := range exactTop(exact)[:8] {
+		assert.Equal(t, w, top[i].Key)
+	}
+	assert.Equal(t, sketch.TopK(8), buffered.TopK(8))
+}
+
+func TestBufferRuns(t *testing.T) {
+	// Runs of the same key are equivalent to a single weighted insert, even
+	// when keys collide and take over buckets from each other
+	sketch := newSketch(2, 2)
+	buffered := newSketch(2, 2)
+	buf := NewBuffer[string](buffered, 1)
+
+	for _, run := range []struct {
+		key   string
+		count int
+	}{{"a", 3}, {"b", 5}, {"a", 1}, {"c", 2}, {"b", 7}} {
+		for i := 0; i < run.count; i++ {
+			sketch.Insert(run.key, 1)
+			buf.Insert(run.key, 1)
+		}
+	}
+	buf.Flush()
+
+	assertSketchesEqual(t, &sketch.GenericSketch, &buffered.GenericSketch)
+}
@@ -0,0 +1,291 @@
+package topkapi
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+// shard is a sub-sketch guarded by its own lock, padded to a cache line to
+// avoid false sharing between neighbouring shards.
+type shard struct {
+	sync.Mutex
+	sk *Sketch
+	_  [48]byte
+}
+
+// ConcurrentSketch is a Sketch that is safe for concurrent use. Inserts are
+// spread across a number of sub-sketches of identical dimensions, which are
+// merged lazily when the sketch is queried or marshalled.
+type ConcurrentSketch struct {
+	shards []shard
+	next   uint32
+	dirty  int32
+
+	mu     sync.Mutex
+	merged *Sketch
+}
+
+// NewConcurrent creates a ConcurrentSketch configured by opts. See
+// NewWithOptions for details.
+func NewConcurrent(opts ...Option) (*ConcurrentSketch, error) {
+	sk, err := NewWithOptions(opts...)
+	if err != nil {
+		return nil, err
+	}
+	return newConcurrentSketch(sk), nil
+}
+
+// newConcurrentSketch creates a ConcurrentSketch with one shard per CPU, the
+// first of which is sk.
+func newConcurrentSketch(sk *Sketch) *ConcurrentSketch {
+	c := &ConcurrentSketch{
+		shards: make([]shard, runtime.GOMAXPROCS(0)),
+		merged: newSketchLike(sk),
+	}
+	c.reset(sk)
+	return c
+}
+
+// reset replaces the contents of all shards with sk. The caller must hold all
+// shard locks or have exclusive access to c.
+func (c *ConcurrentSketch) reset(sk *Sketch) {
+	c.shards[0].sk = sk
+	for i := 1; i < len(c.shards); i++ {
+		c.shards[i].sk = newSketchLike(sk)
+	}
+	atomic.StoreInt32(&c.dirty, 1)
+}
+
+// lock acquires the lock of any shard, preferring one that is not contended.
+func (c *ConcurrentSketch) lock() *shard {
+	var (
+		n     = uint32(len(c.shards))
+		start = atomic.AddUint32(&c.next, 1)
+	)
+
+	for i := uint32(0); i < n; i++ {
+		s := &c.shards[(start+i)%n]
+		if s.TryLock() {
+			return s
+		}
+	}
+
+	s := &c.shards[start%n]
+	s.Lock()
+	return s
+}
+
+func (c *ConcurrentSketch) markDirty() {
+	if atomic.LoadInt32(&c.dirty) == 0 {
+		atomic.StoreInt32(&c.dirty, 1)
+	}
+}
+
+// snapshot returns a sketch holding the merged contents of all shards. The
+// returned sketch must not be modified.
+func (c *ConcurrentSketch) snapshot() *Sketch {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if atomic.LoadInt32(&c.dirty) == 0 {
+		return c.merged
+	}
+	atomic.StoreInt32(&c.dirty, 0)
+
+	merged := newSketchLike(c.merged)
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.Lock()
+		_ = merged.Merge(s.sk)
+		s.Unlock()
+	}
+	c.merged = merged
+
+	return merged
+}
+
+// Epsilon is the approximate error range factor.
+func (c *ConcurrentSketch) Epsilon() float64 {
+	return c.shards[0].sk.Epsilon()
+}
+
+// Delta is the probability for a measurement to be outside the epsilon range
+func (c *ConcurrentSketch) Delta() float64 {
+	return c.shards[0].sk.Delta()
+}
+
+// Dimensions returns the number of rows and the number of buckets per row of
+// each shard.
+func (c *ConcurrentSketch) Dimensions() (rows, buckets uint64) {
+	return c.shards[0].sk.Dimensions()
+}
+
+// MemoryUsage is like Sketch.MemoryUsage, including all shards and the merged
+// sketch queries are answered from.
+func (c *ConcurrentSketch) MemoryUsage() uint64 {
+	size := uint64(unsafe.Sizeof(*c)) + uint64(cap(c.shards))*uint64(unsafe.Sizeof(shard{}))
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.Lock()
+		size += s.sk.MemoryUsage()
+		s.Unlock()
+	}
+
+	c.mu.Lock()
+	size += c.merged.MemoryUsage()
+	c.mu.Unlock()
+	return size
+}
+
+// Insert adds count occurrences of key to the sketch.
+func (c *ConcurrentSketch) Insert(key string, count uint64) {
+	s := c.lock()
+	s.sk.Insert(key, count)
+	s.Unlock()
+	c.markDirty()
+}
+
+// InsertBytes is like Insert, but takes the key as a byte slice.
+func (c *ConcurrentSketch) InsertBytes(key []byte, count uint64) {
+	s := c.lock()
+	s.sk.InsertBytes(key, count)
+	s.Unlock()
+	c.markDirty()
+}
+
+// InsertBatch is like Sketch.InsertBatch. The whole batch goes to a single
+// shard, whose lock is taken once.
+func (c *ConcurrentSketch) InsertBatch(keys []string, counts []uint64) {
+	if len(keys) != len(counts) {
+		panic("topkapi: InsertBatch called with different number of keys and counts")
+	}
+	s := c.lock()
+	s.sk.InsertBatch(keys, counts)
+	s.Unlock()
+	c.markDirty()
+}
+
+// InsertMany is like InsertBatch with a count of 1 for each key.
+func (c *ConcurrentSketch) InsertMany(keys []string) {
+	s := c.lock()
+	s.sk.InsertMany(keys)
+	s.Unlock()
+	c.markDirty()
+}
+
+// Remove is like Sketch.Remove. The occurrences of key may be spread across
+// the shards, so they are all merged into the first one, from which key is
+// then removed. Remove thus blocks all inserts, and costs a merge of all shards.
+func (c *ConcurrentSketch) Remove(key string, count uint64) error {
+	for i := range c.shards {
+		c.shards[i].Lock()
+	}
+	defer func() {
+		for i := range c.shards {
+			c.shards[i].Unlock()
+		}
+	}()
+
+	sk := c.shards[0].sk
+	if sk.conservative {
+		return errRemoveUnsupported
+	}
+	for i := 1; i < len(c.shards); i++ {
+		_ = sk.Merge(c.shards[i].sk)
+		c.shards[i].sk.Reset()
+	}
+	c.markDirty()
+	return sk.Remove(key, count)
+}
+
+// Reset is like Sketch.Reset, emptying all shards.
+func (c *ConcurrentSketch) Reset() {
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.Lock()
+		s.sk.Reset()
+		s.Unlock()
+	}
+	c.markDirty()
+}
+
+// Estimate is like Sketch.Estimate.
+func (c *ConcurrentSketch) Estimate(key string) (uint64, bool) {
+	return c.snapshot().Estimate(key)
+}
+
+// EstimateBytes is like Sketch.EstimateBytes.
+func (c *ConcurrentSketch) EstimateBytes(key []byte) (uint64, bool) {
+	return c.snapshot().EstimateBytes(key)
+}
+
+// Result is like Sketch.Result.
+func (c *ConcurrentSketch) Result(threshold uint64) []LocalHeavyHitter {
+	return c.snapshot().Result(threshold)
+}
+
+// ResultFraction is like Sketch.ResultFraction.
+func (c *ConcurrentSketch) ResultFraction(phi float64) []LocalHeavyHitter {
+	return c.snapshot().ResultFraction(phi)
+}
+
+// Total is like Sketch.Total.
+func (c *ConcurrentSketch) Total() uint64 {
+	return c.snapshot().Total()
+}
+
+// ResultWithVotes is like Sketch.ResultWithVotes.
+func (c *ConcurrentSketch) ResultWithVotes(threshold uint64, minVotes int) []LocalHeavyHitter {
+	return c.snapshot().ResultWithVotes(threshold, minVotes)
+}
+
+// TopK is like Sketch.TopK.
+func (c *ConcurrentSketch) TopK(k int) []LocalHeavyHitter {
+	return c.snapshot().TopK(k)
+}
+
+// Top is like Sketch.Top.
+func (c *ConcurrentSketch) Top() []LocalHeavyHitter {
+	return c.snapshot().Top()
+}
+
+// Merge folds other into c. other is not modified.
+func (c *ConcurrentSketch) Merge(other *Sketch) error {
+	s := c.lock()
+	err := s.sk.Merge(other)
+	s.Unlock()
+	c.markDirty()
+	return err
+}
+
+// Marshal serializes the merged contents of all shards. The result can be
+// unmarshalled into either a Sketch or a ConcurrentSketch.
+func (c *ConcurrentSketch) Marshal() ([]byte, error) {
+	return c.snapshot().Marshal()
+}
+
+// Unmarshal replaces the contents of c with the serialized sketch in p.
+func (c *ConcurrentSketch) Unmarshal(p []byte) error {
+	sk := &Sketch{}
+	if err := sk.Unmarshal(p); err != nil {
+		return err
+	}
+
+	if c.shards == nil {
+		c.shards = make([]shard, runtime.GOMAXPROCS(0))
+	}
+	for i := range c.shards {
+		c.shards[i].Lock()
+	}
+	c.reset(sk)
+	for i := range c.shards {
+		c.shards[i].Unlock()
+	}
+
+	c.mu.Lock()
+	c.merged = newSketchLike(sk)
+	c.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,124 @@
+package topkapi
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConcurrentInsert(t *testing.T) {
+	words := primeWords()
+
+	sketch, _ := NewConcurrent(WithK(20), WithCorpusSize(uint64(len(words))))
+	rows, buckets := sketch.Dimensions()
+	assert.Equal(t, uint64(4), rows)
+	assert.Equal(t, uint64(len(sketch.shards[0].sk.buckets))/rows, buckets)
+	empty := sketch.MemoryUsage()
+	assert.Greater(t, empty, uint64(len(sketch.shards)+1)*rows*buckets*bucketBytes(64))
+
+	var wg sync.WaitGroup
+	for _, slice := range split(words, 16) {
+		wg.Add(1)
+		go func(slice []string) {
+			defer wg.Done()
+			for i, w := range slice {
+				sketch.Insert(w, 1)
+				if i%10000 == 0 {
+					sketch.Result(1000)
+				}
+			}
+		}(slice)
+	}
+	wg.Wait()
+
+	exact := exactCount(words)
+	result := sketch.Result(1)
+	assertErrorRate(t, exact, result, sketch.Delta(), sketch.Epsilon())
+	for i, w := range exactTop(exact)[:8] {
+		assert.Equal(t, w, result[i].Key)
+	}
+
+	assert.Greater(t, sketch.MemoryUsage(), empty)
+
+	count, tracked := sketch.Estimate(result[0].Key)
+	assert.True(t, tracked)
+	assert.Equal(t, result[0].Count, count)
+	assert.Len(t, sketch.Top(), 20)
+
+	p, err := sketch.Marshal()
+	assert.NoError(t, err)
+
+	tmp := &Sketch{}
+	assert.NoError(t, tmp.Unmarshal(p))
+	assert.Equal(t, result, tmp.Result(1))
+
+	other := &ConcurrentSketch{}
+	assert.NoError(t, other.Unmarshal(p))
+	assert.Equal(t, result, other.Result(1))
+
+	// Removing occurrences of a key is like removing them from the merged
+	// sketch
+	total := sketch.Total()
+	assert.NoError(t, tmp.Remove(result[0].Key, exact[result[0].Key]))
+	assert.NoError(t, sketch.Remove(result[0].Key, exact[result[0].Key]))
+	assert.Equal(t, total-exact[result[0].Key], sketch.Total())
+	assert.Equal(t, tmp.Result(1), sketch.Result(1))
+	assert.NotEqual(t, result[0].Key, sketch.Result(1)[0].Key)
+	_, tracked = sketch.Estimate(result[0].Key)
+	assert.False(t, tracked)
+
+	conservative, _ := NewConcurrent(WithDimensions(4, 1000), WithConservativeUpdate())
+	assert.Error(t, conservative.Remove("foo", 1))
+}
+
+func TestConcurrentInsertBatch(t *testing.T) {
+	words := primeWords()
+
+	sketch, _ := NewConcurrent(WithK(20), WithCorpusSize(uint64(len(words))))
+
+	var wg sync.WaitGroup
+	for i, slice := range split(words, 16) {
+		wg.Add(1)
+		go func(i int, slice []string) {
+			defer wg.Done()
+			for _, batch := range split(slice, 10) {
+				if i%2 == 0 {
+					sketch.InsertMany(batch)
+					continue
+				}
+				counts := make([]uint64, len(batch))
+				for j := range counts {
+					counts[j] = 1
+				}
+				sketch.InsertBatch(batch, counts)
+			}
+		}(i, slice)
+	}
+	wg.Wait()
+
+	exact := exactCount(words)
+	result := sketch.Result(1)
+	assert.Equal(t, uint64(len(words)), sketch.Total())
+	assertErrorRate(t, exact, result, sketch.Delta(), sketch.Epsilon())
+	for i, w := range exactTop(exact)[:8] {
+		assert.Equal(t, w, result[i].Key)
+	}
+
+	sketch.Reset()
+	assert.Zero(t, sketch.Total())
+	assert.Empty(t, sketch.ResultWithVotes(0, 1))
+}
+
+func BenchmarkConcurrentInsert(b *testing.B) {
+	words := loadWords()
+	sketch, _ := NewConcurrent(WithK(100), WithCorpusSize(uint64(len(words))))
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			sketch.Insert(words[i%len(words)], 1)
+		}
+	})
+}
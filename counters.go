@@ -0,0 +1,162 @@
+package topkapi
+
+import (
+	"math"
+	"unsafe"
+)
+
+// unsignedCounter is the type of the count-min counter of a bucket.
+type unsignedCounter interface {
+	~uint16 | ~uint32 | ~uint64
+}
+
+// signedCounter is the type of the heavy hitter counter of a bucket.
+type signedCounter interface {
+	~int16 | ~int32 | ~int64
+}
+
+// bucketOf is a single cell of the sketch, with counters of type C and S.
+// The buckets of all rows are stored contiguously, with bucket j of row i at
+// index i*b+j.
+type bucketOf[C unsignedCounter, S signedCounter] struct {
+	cms   C // count-min counter
+	count S // heavy hitter counter of the candidate
+	keyRef
+}
+
+// keyRef is the heavy hitter candidate of a bucket.
+type keyRef struct {
+	key uint32 // index into the sketch's keys
+	tag uint32 // fingerprint of the candidate's hash, checked before its key
+}
+
+type (
+	bucket   = bucketOf[uint64, int64]
+	bucket32 = bucketOf[uint32, int32]
+	bucket16 = bucketOf[uint16, int16]
+)
+
+// bucketBytes returns the size of a bucket with counters of the given width.
+func bucketBytes(width int) uint64 {
+	switch width {
+	case 16:
+		return uint64(unsafe.Sizeof(bucket16{}))
+	case 32:
+		return uint64(unsafe.Sizeof(bucket32{}))
+	}
+	return uint64(unsafe.Sizeof(bucket{}))
+}
+
+// validWidth returns whether counters can be width bits wide.
+func validWidth(width int) bool {
+	return width == 16 || width == 32 || width == 64
+}
+
+// CounterWidth returns the width in bits of the counters of the sketch.
+func (sk *GenericSketch[K]) CounterWidth() int {
+	switch {
+	case sk.buckets16 != nil:
+		return 16
+	case sk.buckets32 != nil:
+		return 32
+	}
+	return 64
+}
+
+// makeBuckets replaces the buckets of sk with empty ones, whose counters are
+// width bits wide.
+func (sk *GenericSketch[K]) makeBuckets(width int) {
+	n := sk.l * sk.b
+	sk.buckets, sk.buckets32, sk.buckets16 = nil, nil, nil
+
+	switch width {
+	case 16:
+		sk.buckets16 = make([]bucket16, n)
+	case 32:
+		sk.buckets32 = make([]bucket32, n)
+	default:
+		sk.buckets = make([]bucket, n)
+	}
+}
+
+// widen promotes the counters of all buckets to the next wider width.
+func (sk *GenericSketch[K]) widen() {
+	switch {
+	case sk.buckets16 != nil:
+		sk.buckets32 = convert[uint32, int32](sk.buckets16)
+		sk.buckets16 = nil
+	case sk.buckets32 != nil:
+		sk.buckets = convert[uint64, int64](sk.buckets32)
+		sk.buckets32 = nil
+	}
+}
+
+// narrow stores the buckets of sk, which must have 64 bit counters, with
+// counters of the given width. It returns false if they do not fit.
+func (sk *GenericSketch[K]) narrow(width int) bool {
+	if width == 64 {
+		return true
+	}
+
+	max := uint64(math.MaxUint16)
+	if width == 32 {
+		max = math.MaxUint32
+	}
+	for _, bk := range sk.buckets {
+		if bk.cms > max || bk.count > int64(max>>1) || bk.count < -int64(max>>1) {
+			return false
+		}
+	}
+
+	switch width {
+	case 16:
+		sk.buckets16 = convert[uint16, int16](sk.buckets)
+	case 32:
+		sk.buckets32 = convert[uint32, int32](sk.buckets)
+	}
+	sk.buckets = nil
+	return true
+}
+
+// convert returns a copy of buckets with counters of type C and S.
+func convert[C unsignedCounter, S signedCounter, C1 unsignedCounter, S1 signedCounter](buckets []bucketOf[C1, S1]) []bucketOf[C, S] {
+	res := make([]bucketOf[C, S], len(buckets))
+	for i, bk := range buckets {
+		res[i] = bucketOf[C, S]{cms: C(bk.cms), count: S(bk.count), keyRef: bk.keyRef}
+	}
+	return res
+}
+
+// bucketAt returns the bucket at index i, with its counters widened to 64 bits.
+func (sk *GenericSketch[K]) bucketAt(i uint64) bucket {
+	switch {
+	case sk.buckets16 != nil:
+		bk := &sk.buckets16[i]
+		return bucket{cms: uint64(bk.cms), count: int64(bk.count), keyRef: bk.keyRef}
+	case sk.buckets32 != nil:
+		bk := &sk.buckets32[i]
+		return bucket{cms: uint64(bk.cms), count: int64(bk.count), keyRef: bk.keyRef}
+	}
+	return sk.buckets[i]
+}
+
+// canStore returns whether cms and count can be stored in bk. 64 bit counters
+// are not checked, as they do not overflow in practice.
+func (bk *bucketOf[C, S]) canStore(cms uint64, count int64) bool {
+	max := uint64(^C(0))
+	if max == math.MaxUint64 {
+		return true
+	}
+	return cms <= max && count <= int64(max>>1) && count >= -int64(max>>1)
+}
+
+// canAdd returns whether count can be added to the counters of bk, and
+// added to or subtracted from its heavy hitter counter.
+func (bk *bucketOf[C, S]) canAdd(count uint64) bool {
+	max := uint64(^C(0))
+	if max == math.MaxUint64 {
+		return true
+	}
+	c := int64(bk.count)
+	return count <= max>>1 && bk.canStore(uint64(bk.cms)+count, c+int64(count)) && bk.canStore(0, c-int64(count))
+}
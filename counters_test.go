@@ -0,0 +1,115 @@
+package topkapi
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCounterWidth(t *testing.T) {
+	words := loadWords()
+
+	_, err := NewWithOptions(WithDimensions(4, 1000), WithCounterWidth(8))
+	assert.Error(t, err)
+
+	for _, width := range []int{16, 32} {
+		wide, _ := NewWithOptions(WithDimensions(4, 1000))
+		narrow, _ := NewWithOptions(WithDimensions(4, 1000), WithCounterWidth(width))
+		assert.Equal(t, width, narrow.CounterWidth())
+		assert.Less(t, narrow.MemoryUsage(), wide.MemoryUsage())
+
+		for _, w := range words[:10000] {
+			wide.Insert(w, 1)
+		}
+		narrow.InsertMany(words[:10000])
+		assert.Equal(t, width, narrow.CounterWidth())
+		assertSketchesEqual(t, &wide.GenericSketch, &narrow.GenericSketch)
+
+		// Counters are promoted instead of overflowing, in every kind of insert
+		wide.Insert("big", 1<<16)
+		narrow.Insert("big", 1<<16)
+		wide.InsertBytes([]byte("bigger"), 1<<31)
+		narrow.InsertBytes([]byte("bigger"), 1<<31)
+		assert.Equal(t, 64, narrow.CounterWidth())
+		assertSketchesEqual(t, &wide.GenericSketch, &narrow.GenericSketch)
+
+		counts := make([]uint64, 1000)
+		for i := range counts {
+			counts[i] = uint64(i) * 100
+		}
+		wide, _ = NewWithOptions(WithDimensions(4, 1000))
+		narrow, _ = NewWithOptions(WithDimensions(4, 1000), WithCounterWidth(width))
+		wide.InsertBatch(words[:1000], counts)
+		narrow.InsertBatch(words[:1000], counts)
+		assertSketchesEqual(t, &wide.GenericSketch, &narrow.GenericSketch)
+
+		// Marshalling records the width
+		p, err := narrow.Marshal()
+		assert.NoError(t, err)
+		tmp := &Sketch{}
+		assert.NoError(t, tmp.Unmarshal(p))
+		assert.Equal(t, narrow.CounterWidth(), tmp.CounterWidth())
+		assertSketchesEqual(t, &narrow.GenericSketch, &tmp.GenericSketch)
+	}
+}
+
+func TestPromoteMidInsert(t *testing.T) {
+	sketch, _ := NewWithOptions(WithDimensions(2, 64), WithCounterWidth(16))
+	buckets := func(key string) (uint64, uint64) {
+		h1, h2 := hashes(sketch.hasher.Hash(key))
+		return uint64(h1) % 64, uint64(h1+h2) % 64
+	}
+
+	// Two keys which share the bucket of x in the second row, and no other.
+	// The second one takes over its bucket in the first row, and then
+	// overflows the counters in the second
+	x0, x1 := buckets("x")
+	var keys []string
+	seen := map[uint64]bool{x0: true}
+	for i := 0; len(keys) < 2; i++ {
+		key := fmt.Sprintf("y%d", i)
+		if b0, b1 := buckets(key); b1 == x1 && !seen[b0] {
+			seen[b0] = true
+			keys = append(keys, key)
+		}
+	}
+
+	for _, bytes := range []bool{false, true} {
+		sketch, _ = NewWithOptions(WithDimensions(2, 64), WithCounterWidth(16))
+		sketch.Insert("x", 1)
+		for _, key := range keys {
+			if bytes {
+				sketch.InsertBytes([]byte(key), 30000)
+			} else {
+				sketch.Insert(key, 30000)
+			}
+		}
+		assert.Equal(t, 32, sketch.CounterWidth())
+		assert.Equal(t, 3, assertInterned(t, sketch))
+		assert.Len(t, sketch.ResultWithVotes(1, 1), 3)
+	}
+}
+
+func TestMergeCounterWidth(t *testing.T) {
+	a, _ := NewWithOptions(WithDimensions(4, 100), WithCounterWidth(16))
+	b, _ := NewWithOptions(WithDimensions(4, 100), WithCounterWidth(16))
+	c, _ := NewWithOptions(WithDimensions(4, 100), WithCounterWidth(16))
+	wide, _ := NewWithOptions(WithDimensions(4, 100))
+	other, _ := NewWithOptions(WithDimensions(4, 100))
+	for _, sk := range []*Sketch{a, b, c, wide, other} {
+		sk.Insert("foo", 30000)
+		sk.Insert("bar", 100)
+	}
+
+	assert.NoError(t, a.Merge(b))
+	assert.Equal(t, 32, a.CounterWidth())
+	count, _ := a.Estimate("foo")
+	assert.Equal(t, uint64(60000), count)
+
+	// Sketches of different widths can be merged either way
+	assert.NoError(t, b.Merge(other))
+	assert.NoError(t, wide.Merge(c))
+	assertSketchesEqual(t, &a.GenericSketch, &b.GenericSketch)
+	assertSketchesEqual(t, &a.GenericSketch, &wide.GenericSketch)
+}
@@ -0,0 +1,187 @@
+package topkapi
+
+import (
+	"errors"
+	"math"
+	"time"
+)
+
+const (
+	// decayUnit is the weight of a single occurrence inserted at the landmark
+	// of a DecayedSketch, which bounds the rounding error of decayed counts.
+	decayUnit = 1 << 8
+	// decayPeriods is the number of half-lives after which the counters of a
+	// DecayedSketch are scaled down and its landmark is moved forward.
+	decayPeriods = 16
+)
+
+// DecayedSketch is a Sketch whose counts decay exponentially with time, so
+// that its results favor keys which were heavy recently. Each occurrence
+// counts for half as much once a half-life has passed since it was inserted.
+//
+// Decay is applied lazily: instead of decaying all counters as time passes,
+// occurrences are inserted with a weight that grows exponentially with their
+// time, relative to a landmark. Counts are scaled back to the present when
+// the sketch is queried. Inserts stay as cheap as those of a Sketch, and once
+// every 16 half-lives all counters are scaled down and the landmark moves
+// forward, before the weights of new occurrences grow too large.
+//
+// The present of a DecayedSketch is the latest time it was given by Insert or
+// Advance, and counts are reported decayed to it, rounded to whole numbers.
+// Occurrences may be inserted out of order, and count for less the older they
+// are.
+type DecayedSketch struct {
+	sk       *Sketch
+	halfLife time.Duration
+	landmark time.Time
+	now      time.Time
+}
+
+// NewDecayed creates a DecayedSketch with the given half-life, configured by
+// opts. See NewWithOptions for details.
+func NewDecayed(halfLife time.Duration, opts ...Option) (*DecayedSketch, error) {
+	sk, err := NewWithOptions(opts...)
+	if err != nil {
+		return nil, err
+	}
+	return newDecayedSketch(sk, halfLife)
+}
+
+func newDecayedSketch(sk *Sketch, halfLife time.Duration) (*DecayedSketch, error) {
+	if halfLife <= 0 {
+		return nil, errors.New("topkapi: half-life must be positive")
+	}
+	return &DecayedSketch{sk: sk, halfLife: halfLife}, nil
+}
+
+// HalfLife returns the time after which the count of an occurrence is halved.
+func (d *DecayedSketch) HalfLife() time.Duration {
+	return d.halfLife
+}
+
+// Epsilon is the approximate error range factor.
+func (d *DecayedSketch) Epsilon() float64 {
+	return d.sk.Epsilon()
+}
+
+// Delta is the probability for a measurement to be outside the epsilon range
+func (d *DecayedSketch) Delta() float64 {
+	return d.sk.Delta()
+}
+
+// scale returns the weight of a single occurrence at time t.
+func (d *DecayedSketch) scale(t time.Time) float64 {
+	return decayUnit * math.Exp2(float64(t.Sub(d.landmark))/float64(d.halfLife))
+}
+
+// Insert adds count occurrences of key at time t to the sketch.
+func (d *DecayedSketch) Insert(key string, count uint64, t time.Time) {
+	d.Advance(t)
+	if w := math.Round(float64(count) * d.scale(t)); w >= 1 {
+		d.sk.Insert(key, uint64(w))
+	}
+}
+
+// Advance moves the present of the sketch to t, decaying all counts up to t.
+// Times before the present are ignored.
+func (d *DecayedSketch) Advance(t time.Time) {
+	switch {
+	case d.landmark.IsZero():
+		d.landmark, d.now = t, t
+		return
+	case !t.After(d.now):
+		return
+	}
+	d.now = t
+
+	if periods := uint64(d.now.Sub(d.landmark) / d.halfLife); periods >= decayPeriods {
+		d.sk.scaleDown(periods)
+		d.landmark = d.landmark.Add(time.Duration(periods) * d.halfLife)
+	}
+}
+
+// decayed returns the count for the weight w, decayed to the present.
+func (d *DecayedSketch) decayed(w uint64) uint64 {
+	return uint64(math.Round(float64(w) / d.scale(d.now)))
+}
+
+// decay decays the counts of hhs to the present.
+func (d *DecayedSketch) decay(hhs []LocalHeavyHitter) []LocalHeavyHitter {
+	for i := range hhs {
+		hhs[i].Count = d.decayed(hhs[i].Count)
+		hhs[i].Lower = d.decayed(hhs[i].Lower)
+	}
+	return hhs
+}
+
+// Estimate is like Sketch.Estimate, with the count decayed to the present.
+func (d *DecayedSketch) Estimate(key string) (uint64, bool) {
+	count, tracked := d.sk.Estimate(key)
+	return d.decayed(count), tracked
+}
+
+// Total is like Sketch.Total, with the total decayed to the present.
+func (d *DecayedSketch) Total() uint64 {
+	return d.decayed(d.sk.Total())
+}
+
+// Result is like Sketch.Result, with threshold and counts decayed to the
+// present.
+func (d *DecayedSketch) Result(threshold uint64) []LocalHeavyHitter {
+	return d.ResultWithVotes(threshold, d.sk.majority())
+}
+
+// ResultFraction is like Sketch.ResultFraction, with counts decayed to the
+// present.
+func (d *DecayedSketch) ResultFraction(phi float64) []LocalHeavyHitter {
+	return d.decay(d.sk.ResultFraction(phi))
+}
+
+// ResultWithVotes is like Sketch.ResultWithVotes, with threshold and counts
+// decayed to the present.
+func (d *DecayedSketch) ResultWithVotes(threshold uint64, minVotes int) []LocalHeavyHitter {
+	w := uint64(math.Ceil(float64(threshold) * d.scale(d.now)))
+	return d.decay(d.sk.ResultWithVotes(w, minVotes))
+}
+
+// TopK is like Sketch.TopK, with counts decayed to the present.
+func (d *DecayedSketch) TopK(k int) []LocalHeavyHitter {
+	return d.decay(d.sk.TopK(k))
+}
+
+// Top is like Sketch.Top, with counts decayed to the present.
+func (d *DecayedSketch) Top() []LocalHeavyHitter {
+	return d.decay(d.sk.Top())
+}
+
+// scaleDown divides all counts of sk by 2^shift. Candidates whose heavy
+// hitter counter drops to zero are released.
+func (sk *GenericSketch[K]) scaleDown(shift uint64) {
+	sk.total >>= shift
+
+	switch {
+	case sk.buckets16 != nil:
+		scaleDown(sk, sk.buckets16, shift)
+	case sk.buckets32 != nil:
+		scaleDown(sk, sk.buckets32, shift)
+	default:
+		scaleDown(sk, sk.buckets, shift)
+	}
+}
+
+func scaleDown[K comparable, C unsignedCounter, S signedCounter](sk *GenericSketch[K], buckets []bucketOf[C, S], shift uint64) {
+	for i := range buckets {
+		bk := &buckets[i]
+		bk.cms >>= shift
+
+		switch {
+		case bk.count < 0:
+			bk.count = -(-bk.count >> shift)
+		case bk.count > 0:
+			if bk.count >>= shift; bk.count == 0 {
+				sk.keys.release(bk.key)
+				bk.keyRef = keyRef{}
+			}
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package topkapi
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDecayedSketch(t *testing.T) {
+	_, err := NewDecayed(0, WithDimensions(4, 1000))
+	assert.Error(t, err)
+
+	d, err := NewDecayed(time.Hour, WithDimensions(4, 1000))
+	assert.NoError(t, err)
+	assert.Equal(t, time.Hour, d.HalfLife())
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, w := range loadWords()[:10000] {
+		d.Insert(w, 1, start.Add(time.Duration(i)*time.Millisecond))
+	}
+	d.Insert("old", 4000, start)
+	count, _ := d.Estimate("old")
+	assert.InDelta(t, 4000, count, 10)
+
+	// A key inserted later outweighs a heavier one that has since decayed
+	d.Insert("new", 1000, start.Add(3*time.Hour))
+	count, _ = d.Estimate("old")
+	assert.InDelta(t, 500, count, 10)
+	result := d.Result(100)
+	if assert.Len(t, result, 2) {
+		assert.Equal(t, "new", result[0].Key)
+		assert.InDelta(t, 1000, result[0].Count, 10)
+		assert.Equal(t, "old", result[1].Key)
+	}
+	assert.InDelta(t, (10000+4000)/8+1000, d.Total(), 10)
+
+	// Occurrences inserted out of order count for less
+	d.Insert("late", 1000, start.Add(2*time.Hour))
+	count, _ = d.Estimate("late")
+	assert.InDelta(t, 500, count, 10)
+	assert.Equal(t, "new", d.TopK(1)[0].Key)
+
+	// A steady stream converges to the rate times the mean lifetime, across
+	// many rescalings of the counters
+	for i := 0; i < 100*60; i++ {
+		d.Insert("steady", 10, start.Add(3*time.Hour+time.Duration(i)*time.Minute))
+	}
+	count, _ = d.Estimate("steady")
+	assert.InDelta(t, 10*60/math.Ln2, count, 10)
+	assert.Equal(t, "steady", d.ResultFraction(0.5)[0].Key)
+	for _, w := range []string{"old", "new", "late"} {
+		count, _ := d.Estimate(w)
+		assert.Zero(t, count, w)
+	}
+	assert.Less(t, d.sk.keys.len(), 10)
+
+	// Advancing without inserts lets everything decay
+	d.Advance(start.Add(1000 * time.Hour))
+	assert.Zero(t, d.Total())
+	assert.Empty(t, d.ResultWithVotes(0, 1))
+}
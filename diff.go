@@ -0,0 +1,183 @@
+package topkapi
+
+import (
+	"math"
+	"sort"
+)
+
+// Subtract removes the counts of other from sk, so that sk summarizes the
+// difference between both streams, such as what got hot in one period
+// compared to the one before.
+//
+// The count-min rows become the difference of the buckets, stopping at zero
+// for buckets whose count decreased. The candidates are then recomputed: if
+// other's bucket has the same candidate, its counter is subtracted, and every
+// candidate's counter is lowered to at most its key's new count-min estimate.
+// Candidates are dropped once nothing is left of them, so buckets which did not
+// gain count lose their candidate.
+//
+// The counts of keys that increased are estimates of their increase, but no
+// longer upper bounds: keys whose count decreased reduce the count of any key
+// sharing their buckets. Total becomes the difference of the totals, again
+// stopping at zero.
+//
+// Sketches can only be subtracted under the same conditions as they can be
+// merged, and not if they use conservative updates, whose counters cannot be
+// subtracted.
+func (sk *GenericSketch[K]) Subtract(other *GenericSketch[K]) error {
+	if !sk.compatible(other) || sk.conservative {
+		return incompatibleSketches
+	}
+
+	if other.total > sk.total {
+		sk.total = 0
+	} else {
+		sk.total -= other.total
+	}
+
+	switch {
+	case sk.buckets16 != nil:
+		subtract(sk, sk.buckets16, other)
+	case sk.buckets32 != nil:
+		subtract(sk, sk.buckets32, other)
+	default:
+		subtract(sk, sk.buckets, other)
+	}
+	return nil
+}
+
+// Subtract is like GenericSketch.Subtract.
+func (sk *Sketch) Subtract(other *Sketch) error {
+	return sk.GenericSketch.Subtract(&other.GenericSketch)
+}
+
+// subtract subtracts the buckets of other from buckets. Counters only
+// decrease, so they can't overflow.
+func subtract[K comparable, C unsignedCounter, S signedCounter](sk *GenericSketch[K], buckets []bucketOf[C, S], other *GenericSketch[K]) {
+	for i := range buckets {
+		bk, obk := &buckets[i], other.bucketAt(uint64(i))
+
+		if uint64(bk.cms) < obk.cms {
+			bk.cms = 0
+		} else {
+			bk.cms -= C(obk.cms)
+		}
+
+		if bk.count <= 0 || obk.count <= 0 || !sk.holds(&bk.keyRef, other.keys.key(obk.key), obk.tag) {
+			continue
+		}
+		if int64(bk.count) > obk.count {
+			bk.count -= S(obk.count)
+		} else {
+			sk.keys.release(bk.key)
+			bk.keyRef = keyRef{}
+			bk.count = 0
+		}
+	}
+
+	var zero K
+	for i := range buckets {
+		bk := &buckets[i]
+		if bk.count <= 0 {
+			continue
+		}
+		hsum := sk.keys.hash(bk.key)
+		if bk.key == 0 {
+			hsum = sk.hasher.Hash(zero)
+		}
+		if est := minCMS(sk, buckets, hsum); est == 0 {
+			sk.keys.release(bk.key)
+			bk.keyRef = keyRef{}
+			bk.count = 0
+		} else if uint64(bk.count) > est {
+			bk.count = S(est)
+		}
+	}
+}
+
+// minCMS returns the smallest count-min counter of the buckets of the key with
+// hash sum hsum, which is its estimate.
+func minCMS[K comparable, C unsignedCounter, S signedCounter](sk *GenericSketch[K], buckets []bucketOf[C, S], hsum uint64) uint64 {
+	h1, h2 := hashes(hsum)
+	min := uint64(math.MaxUint64)
+	for i := uint64(0); i < sk.l; i++ {
+		h := uint64((h1 + uint32(i)*h2))
+		if c := uint64(buckets[i*sk.b+h%sk.b].cms); c < min {
+			min = c
+		}
+	}
+	return min
+}
+
+// GenericChange is the change of the estimated count of a key between two
+// sketches, as reported by GenericDiff.
+type GenericChange[K comparable] struct {
+	Key    K
+	Before uint64 // estimated count in the earlier sketch
+	After  uint64 // estimated count in the later sketch
+}
+
+// Change is the change of the estimated count of a key, as reported by Diff.
+type Change = GenericChange[string]
+
+// Delta returns the difference of the estimated counts.
+func (c GenericChange[K]) Delta() int64 {
+	return int64(c.After - c.Before)
+}
+
+// Diff is GenericDiff for sketches over string keys.
+func Diff(a, b *Sketch, k int) (increased, decreased []Change) {
+	return GenericDiff(&a.GenericSketch, &b.GenericSketch, k)
+}
+
+// GenericDiff compares the sketch a of a period with the sketch b of an
+// earlier one. It returns the k keys whose count increased the most, ordered
+// by descending increase, and the k keys whose count decreased the most,
+// ordered by descending decrease.
+//
+// Only the heavy hitter candidates of either sketch are considered, and their
+// counts are compared by their count-min estimates. The sketches don't need to
+// be compatible, but the estimates are most comparable for sketches of the same
+// dimensions.
+func GenericDiff[K comparable](a, b *GenericSketch[K], k int) (increased, decreased []GenericChange[K]) {
+	var (
+		seen    = make(map[K]struct{})
+		changes []GenericChange[K]
+	)
+	for _, sk := range []*GenericSketch[K]{a, b} {
+		for i := uint64(0); i < sk.l*sk.b; i++ {
+			bk := sk.bucketAt(i)
+			if bk.count <= 0 {
+				continue
+			}
+			key := sk.keys.key(bk.key)
+			if _, ok := seen[key]; ok {
+				continue
+			}
+			seen[key] = struct{}{}
+
+			after, _ := a.Estimate(key)
+			before, _ := b.Estimate(key)
+			if after != before {
+				changes = append(changes, GenericChange[K]{Key: key, Before: before, After: after})
+			}
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Delta() > changes[j].Delta()
+	})
+	for _, c := range changes {
+		if len(increased) == k || c.Delta() < 0 {
+			break
+		}
+		increased = append(increased, c)
+	}
+	for i := len(changes) - 1; i >= 0; i-- {
+		if len(decreased) == k || changes[i].Delta() > 0 {
+			break
+		}
+		decreased = append(decreased, changes[i])
+	}
+	return increased, decreased
+}
@@ -0,0 +1,62 @@
+package topkapi
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSubtract(t *testing.T) {
+	words := zipfWords(loadWords(), 100000)
+
+	before, _ := NewWithOptions(WithDimensions(4, 1000), WithCounterWidth(16))
+	after, _ := NewWithOptions(WithDimensions(4, 1000), WithCounterWidth(16))
+	before.InsertMany(words)
+	before.Insert("cold", 3000)
+	after.InsertMany(words)
+	after.Insert("hot", 5000)
+
+	increased, decreased := Diff(after, before, 3)
+	assert.Len(t, increased, 3)
+	assert.Equal(t, "hot", increased[0].Key)
+	assert.GreaterOrEqual(t, increased[0].Delta(), int64(5000))
+	assert.Equal(t, "cold", decreased[0].Key)
+	assert.LessOrEqual(t, decreased[0].Delta(), int64(-3000))
+	top := exactTop(exactCount(words))[0]
+	for _, c := range append(increased, decreased...) {
+		assert.NotEqual(t, top, c.Key)
+	}
+
+	assert.NoError(t, after.Subtract(before))
+	assert.Equal(t, uint64(5000-3000), after.Total())
+	result := after.Result(1)
+	if assert.NotEmpty(t, result) {
+		assert.Equal(t, "hot", result[0].Key)
+		assert.GreaterOrEqual(t, result[0].Count, uint64(5000))
+	}
+	count, _ := after.Estimate("cold")
+	assert.Zero(t, count)
+	for _, hh := range after.ResultWithVotes(0, 1) {
+		assert.LessOrEqual(t, hh.Lower, hh.Count, hh.Key)
+	}
+
+	// Subtracting a sketch from itself leaves it empty
+	assert.NoError(t, before.Subtract(before))
+	assert.Zero(t, before.Total())
+	assert.Empty(t, before.ResultWithVotes(0, 1))
+	assert.Zero(t, before.keys.len())
+
+	// Candidates of buckets that lost count are dropped
+	a, _ := NewWithOptions(WithDimensions(4, 1))
+	b, _ := NewWithOptions(WithDimensions(4, 1))
+	a.Insert("x", 10)
+	b.Insert("y", 50)
+	assert.NoError(t, a.Subtract(b))
+	assert.Empty(t, a.TopK(3))
+	assert.Zero(t, a.keys.len())
+
+	other, _ := NewWithOptions(WithDimensions(4, 100))
+	assert.Equal(t, incompatibleSketches, after.Subtract(other))
+	conservative, _ := NewWithOptions(WithDimensions(4, 1000), WithConservativeUpdate())
+	assert.Equal(t, incompatibleSketches, conservative.Subtract(conservative))
+}
@@ -0,0 +1,210 @@
+package topkapi
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+	"reflect"
+
+	"github.com/dgryski/go-metro"
+	"github.com/zeebo/xxh3"
+)
+
+// Hasher hashes keys of type K for a GenericSketch. Both halves of the hash
+// are used to derive the bucket in each row, so all 64 bits should be well
+// distributed.
+type Hasher[K comparable] interface {
+	Hash(key K) uint64
+}
+
+// BytesHasher is implemented by string hashers that can hash a byte slice
+// without converting it to a string first. It must return the same hash as
+// Hash does for the equivalent string.
+type BytesHasher interface {
+	HashBytes(key []byte) uint64
+}
+
+// HasherFunc adapts a function to the Hasher interface.
+type HasherFunc[K comparable] func(key K) uint64
+
+// Hash calls f(key).
+func (f HasherFunc[K]) Hash(key K) uint64 {
+	return f(key)
+}
+
+// HashFunc identifies one of the hash functions provided by this package.
+type HashFunc string
+
+const (
+	// Metro is metro hash, the default hash function for string keys.
+	Metro HashFunc = "metro"
+	// XXH3 is the XXH3 variant of xxhash.
+	XXH3 HashFunc = "xxh3"
+	// SplitMix is the splitmix64 finalizer used for integer and address keys.
+	SplitMix HashFunc = "splitmix64"
+)
+
+// DefaultSeed is the seed of the default hasher for string keys.
+const DefaultSeed = 1337
+
+// IdentifiedHasher is implemented by hashers whose configuration can be
+// persisted along with a sketch when it is marshalled.
+type IdentifiedHasher interface {
+	HashID() (HashFunc, uint64)
+}
+
+// MetroHasher hashes string keys with metro hash. With DefaultSeed, it is the
+// hasher used by Sketch unless configured otherwise.
+type MetroHasher struct {
+	Seed uint64
+}
+
+// Hash implements Hasher.
+func (h MetroHasher) Hash(key string) uint64 {
+	return metro.Hash64Str(key, h.Seed)
+}
+
+// HashBytes implements BytesHasher.
+func (h MetroHasher) HashBytes(key []byte) uint64 {
+	return metro.Hash64(key, h.Seed)
+}
+
+// HashID implements IdentifiedHasher.
+func (h MetroHasher) HashID() (HashFunc, uint64) {
+	return Metro, h.Seed
+}
+
+// XXH3Hasher hashes string keys with XXH3.
+type XXH3Hasher struct {
+	Seed uint64
+}
+
+// Hash implements Hasher.
+func (h XXH3Hasher) Hash(key string) uint64 {
+	return xxh3.HashStringSeed(key, h.Seed)
+}
+
+// HashBytes implements BytesHasher.
+func (h XXH3Hasher) HashBytes(key []byte) uint64 {
+	return xxh3.HashSeed(key, h.Seed)
+}
+
+// HashID implements IdentifiedHasher.
+func (h XXH3Hasher) HashID() (HashFunc, uint64) {
+	return XXH3, h.Seed
+}
+
+// newStringHasher returns the hasher for string keys identified by fn and seed.
+func newStringHasher(fn HashFunc, seed uint64) (Hasher[string], error) {
+	switch fn {
+	case Metro:
+		return MetroHasher{Seed: seed}, nil
+	case XXH3:
+		return XXH3Hasher{Seed: seed}, nil
+	default:
+		return nil, fmt.Errorf("topkapi: unknown hash function %q for string keys", fn)
+	}
+}
+
+// sameHasher reports whether a and b are known to hash keys identically.
+// Function hashers, like HasherFunc, are identical if they are the same
+// function. Closures of the same function literal can't be told apart, so
+// they are assumed to be identical whatever they capture. Hashers of other
+// types that cannot be compared are never known to be identical.
+func sameHasher[K comparable](a, b Hasher[K]) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	ta, tb := reflect.TypeOf(a), reflect.TypeOf(b)
+	switch {
+	case ta != tb:
+		return false
+	case ta.Kind() == reflect.Func:
+		return reflect.ValueOf(a).Pointer() == reflect.ValueOf(b).Pointer()
+	case !ta.Comparable():
+		return false
+	}
+	return a == b
+}
+
+type integer interface {
+	~int | ~int8 | ~int16 | ~int32 | ~int64 |
+		~uint | ~uint8 | ~uint16 | ~uint32 | ~uint64 | ~uintptr
+}
+
+// IntHasher hashes integer keys.
+type IntHasher[K integer] struct {
+	Seed uint64
+}
+
+// Hash implements Hasher.
+func (h IntHasher[K]) Hash(key K) uint64 {
+	return mix64(uint64(key) ^ h.Seed)
+}
+
+// HashID implements IdentifiedHasher.
+func (h IntHasher[K]) HashID() (HashFunc, uint64) {
+	return SplitMix, h.Seed
+}
+
+// AddrHasher hashes IP address keys. The zone of IPv6 addresses is ignored.
+type AddrHasher struct {
+	Seed uint64
+}
+
+// Hash implements Hasher.
+func (h AddrHasher) Hash(key netip.Addr) uint64 {
+	p := key.As16()
+	return mix64(binary.LittleEndian.Uint64(p[:8]) ^ mix64(binary.LittleEndian.Uint64(p[8:])^h.Seed))
+}
+
+// HashID implements IdentifiedHasher.
+func (h AddrHasher) HashID() (HashFunc, uint64) {
+	return SplitMix, h.Seed
+}
+
+// mix64 is the splitmix64 finalizer, which spreads the entropy of x over all bits.
+func mix64(x uint64) uint64 {
+	x += 0x9e3779b97f4a7c15
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
+
+// KeyCodec encodes keys of type K for serialization of a GenericSketch.
+type KeyCodec[K comparable] interface {
+	EncodeKey(key K) ([]byte, error)
+	DecodeKey(p []byte) (K, error)
+}
+
+// IntCodec encodes integer keys as 8 little endian bytes.
+type IntCodec[K integer] struct{}
+
+// EncodeKey implements KeyCodec.
+func (IntCodec[K]) EncodeKey(key K) ([]byte, error) {
+	return binary.LittleEndian.AppendUint64(nil, uint64(key)), nil
+}
+
+// DecodeKey implements KeyCodec.
+func (IntCodec[K]) DecodeKey(p []byte) (K, error) {
+	if len(p) != 8 {
+		return 0, errors.New("topkapi: integer key must be 8 bytes")
+	}
+	return K(binary.LittleEndian.Uint64(p)), nil
+}
+
+// AddrCodec encodes IP address keys in their binary form.
+type AddrCodec struct{}
+
+// EncodeKey implements KeyCodec.
+func (AddrCodec) EncodeKey(key netip.Addr) ([]byte, error) {
+	return key.MarshalBinary()
+}
+
+// DecodeKey implements KeyCodec.
+func (AddrCodec) DecodeKey(p []byte) (netip.Addr, error) {
+	var key netip.Addr
+	err := key.UnmarshalBinary(p)
+	return key, err
+}
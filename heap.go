@@ -0,0 +1,21 @@
+package topkapi
+
+// minHeap is a min-heap of heavy hitters ordered by count, used to keep the
+// k heaviest candidates seen so far.
+type minHeap[K comparable] []GenericLocalHeavyHitter[K]
+
+func (h minHeap[K]) Len() int           { return len(h) }
+func (h minHeap[K]) Less(i, j int) bool { return h[i].Count < h[j].Count }
+func (h minHeap[K]) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *minHeap[K]) Push(x interface{}) {
+	*h = append(*h, x.(GenericLocalHeavyHitter[K]))
+}
+
+func (h *minHeap[K]) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[:n-1]
+	return x
+}
@@ -0,0 +1,341 @@
+package topkapi
+
+import (
+	"errors"
+	"net/netip"
+	"sort"
+	"strings"
+
+	"github.com/axiomhq/topkapi/internal/msgp"
+)
+
+// Generalizer maps keys to their ancestors in a hierarchy, such as the
+// directories of a path or the networks of an IP address, for a
+// HierarchicalSketch.
+type Generalizer interface {
+	// Levels returns the number of levels of the hierarchy, including the
+	// keys themselves.
+	Levels() int
+	// Generalize returns the ancestor of key at the given level, from key
+	// itself at level 0 to its most general ancestor at Levels()-1, and false
+	// if key has no ancestor at that level. The key may itself be an ancestor
+	// at a lower level.
+	Generalize(key string, level int) (string, bool)
+}
+
+// PathGeneralizer generalizes slash separated paths to their first segments,
+// down to Depth segments at level 1 and a single one at the most general
+// level. Ancestors end in a wildcard segment: /api/v1/users/42 generalizes to
+// /api/v1/users/*, /api/v1/* and /api/* at a Depth of 3. Paths with fewer
+// segments than a level keeps generalize to all of them, so /api/v1 is
+// /api/v1/* at levels 1 and 2.
+type PathGeneralizer struct {
+	Depth int
+}
+
+// Levels implements Generalizer.
+func (g PathGeneralizer) Levels() int {
+	return g.Depth + 1
+}
+
+// Generalize implements Generalizer.
+func (g PathGeneralizer) Generalize(key string, level int) (string, bool) {
+	if level == 0 {
+		return key, true
+	}
+	if level > g.Depth {
+		return "", false
+	}
+
+	segments := strings.Split(strings.Trim(strings.TrimSuffix(key, "/*"), "/"), "/")
+	if n := g.Depth - level + 1; n < len(segments) {
+		segments = segments[:n]
+	}
+	if len(segments) == 1 && segments[0] == "" {
+		return "/*", true
+	}
+	return "/" + strings.Join(segments, "/") + "/*", true
+}
+
+// DomainGeneralizer generalizes domain names to their last labels, down to
+// Depth labels at level 1 and a single one at the most general level.
+// Ancestors start with a wildcard label: api.eu.example.com generalizes to
+// *.eu.example.com, *.example.com and *.com at a Depth of 3.
+type DomainGeneralizer struct {
+	Depth int
+}
+
+// Levels implements Generalizer.
+func (g DomainGeneralizer) Levels() int {
+	return g.Depth + 1
+}
+
+// Generalize implements Generalizer.
+func (g DomainGeneralizer) Generalize(key string, level int) (string, bool) {
+	if level == 0 {
+		return key, true
+	}
+	if level > g.Depth {
+		return "", false
+	}
+
+	labels := strings.Split(strings.TrimSuffix(strings.TrimPrefix(key, "*."), "."), ".")
+	if n := g.Depth - level + 1; n < len(labels) {
+		labels = labels[len(labels)-n:]
+	}
+	return "*." + strings.Join(labels, "."), true
+}
+
+// IPGeneralizer generalizes IP addresses to the networks containing them,
+// with the prefix lengths of IPv4 and IPv6 addresses at levels 1 and up given
+// by IPv4 and IPv6, from the longest to the shortest. With an IPv4 of
+// []int{24, 16}, 10.2.3.4 generalizes to 10.2.3.0/24 and 10.2.0.0/16. Keys
+// that are not IP addresses have no ancestors.
+type IPGeneralizer struct {
+	IPv4 []int
+	IPv6 []int
+}
+
+// Levels implements Generalizer.
+func (g IPGeneralizer) Levels() int {
+	if len(g.IPv6) > len(g.IPv4) {
+		return len(g.IPv6) + 1
+	}
+	return len(g.IPv4) + 1
+}
+
+// Generalize implements Generalizer.
+func (g IPGeneralizer) Generalize(key string, level int) (string, bool) {
+	if level == 0 {
+		return key, true
+	}
+
+	var addr netip.Addr
+	if prefix, err := netip.ParsePrefix(key); err == nil {
+		addr = prefix.Addr()
+	} else if addr, err = netip.ParseAddr(key); err != nil {
+		return "", false
+	}
+
+	bits := g.IPv6
+	if addr.Is4() {
+		bits = g.IPv4
+	}
+	if level > len(bits) {
+		return "", false
+	}
+	prefix, err := addr.Prefix(bits[level-1])
+	if err != nil {
+		return "", false
+	}
+	return prefix.String(), true
+}
+
+// HierarchicalHeavyHitter is a heavy hitter of a level of a
+// HierarchicalSketch.
+type HierarchicalHeavyHitter struct {
+	Key string
+	// Count is the estimated count of the key, including all its descendants.
+	Count uint64
+	// Discounted is the part of Count that is not accounted for by the heavy
+	// hitters reported among the descendants of the key.
+	Discounted uint64
+}
+
+// HierarchicalSketch finds heavy hitters among keys and their ancestors in a
+// hierarchy, such as heavy directories of paths or networks of IP addresses
+// on top of heavy paths and addresses. Each level of the hierarchy, as given
+// by a Generalizer, is counted by a Sketch of its own.
+//
+// Ancestors whose count is mostly made of a few heavy descendants carry little
+// information of their own. Result therefore discounts the counts of the heavy
+// hitters reported at lower levels from those of their ancestors.
+type HierarchicalSketch struct {
+	levels []*Sketch
+	gen    Generalizer
+}
+
+// NewHierarchical creates a HierarchicalSketch over the hierarchy given by
+// gen, whose levels are configured by opts. See NewWithOptions for details.
+func NewHierarchical(gen Generalizer, opts ...Option) (*HierarchicalSketch, error) {
+	sk, err := NewWithOptions(opts...)
+	if err != nil {
+		return nil, err
+	}
+	return newHierarchicalSketch(sk, gen)
+}
+
+// newHierarchicalSketch creates a HierarchicalSketch whose levels are like sk,
+// the first of which is sk.
+func newHierarchicalSketch(sk *Sketch, gen Generalizer) (*HierarchicalSketch, error) {
+	if gen == nil || gen.Levels() < 1 {
+		return nil, errors.New("topkapi: a hierarchy needs at least one level")
+	}
+
+	h := &HierarchicalSketch{
+		levels: make([]*Sketch, gen.Levels()),
+		gen:    gen,
+	}
+	h.levels[0] = sk
+	for i := 1; i < len(h.levels); i++ {
+		h.levels[i] = newSketchLike(sk)
+	}
+	return h, nil
+}
+
+// Levels returns the number of levels of the hierarchy.
+func (h *HierarchicalSketch) Levels() int {
+	return len(h.levels)
+}
+
+// Level returns the sketch of the given level, which counts the ancestors of
+// keys at that level and can be queried like any other sketch. It must not be
+// modified.
+func (h *HierarchicalSketch) Level(level int) *Sketch {
+	return h.levels[level]
+}
+
+// Epsilon is the approximate error range factor of each level.
+func (h *HierarchicalSketch) Epsilon() float64 {
+	return h.levels[0].Epsilon()
+}
+
+// Delta is the probability for a measurement to be outside the epsilon range
+func (h *HierarchicalSketch) Delta() float64 {
+	return h.levels[0].Delta()
+}
+
+// Insert adds count occurrences of key to the sketch of each level it has an
+// ancestor at.
+func (h *HierarchicalSketch) Insert(key string, count uint64) {
+	for i, sk := range h.levels {
+		if k, ok := h.gen.Generalize(key, i); ok {
+			sk.Insert(k, count)
+		}
+	}
+}
+
+// Total returns the total count inserted into the sketch and the sketches
+// merged into it.
+func (h *HierarchicalSketch) Total() uint64 {
+	return h.levels[0].Total()
+}
+
+// Result returns the hierarchical heavy hitters of each level, indexed by
+// level and ordered by descending discounted count. Levels are processed from
+// the most specific one up: a key of a level is reported if its discounted
+// count is at least threshold, which is its count less the counts of the
+// heavy hitters reported among its descendants, not counting those below
+// another reported descendant twice.
+//
+// The candidates of each level are those reported by Sketch.Result, so their
+// counts are upper bounds, and the discounted counts are estimates.
+func (h *HierarchicalSketch) Result(threshold uint64) [][]HierarchicalHeavyHitter {
+	type reported struct {
+		key   string
+		count uint64
+	}
+
+	var (
+		res = make([][]HierarchicalHeavyHitter, len(h.levels))
+		// heavy hitters of lower levels without a reported ancestor yet
+		frontier []reported
+	)
+	for i, sk := range h.levels {
+		var (
+			covered   = make(map[string]uint64)
+			ancestors = make([]string, len(frontier))
+		)
+		for j, hh := range frontier {
+			if key, ok := h.gen.Generalize(hh.key, i); ok {
+				ancestors[j] = key
+				covered[key] += hh.count
+			}
+		}
+
+		heavy := make(map[string]bool)
+		for _, hh := range sk.Result(threshold) {
+			var discounted uint64
+			if c := covered[hh.Key]; c < hh.Count {
+				discounted = hh.Count - c
+			}
+			if discounted >= threshold {
+				res[i] = append(res[i], HierarchicalHeavyHitter{Key: hh.Key, Count: hh.Count, Discounted: discounted})
+				heavy[hh.Key] = true
+			}
+		}
+		sort.SliceStable(res[i], func(a, b int) bool {
+			return res[i][a].Discounted > res[i][b].Discounted
+		})
+
+		next := frontier[:0]
+		for j, hh := range frontier {
+			if !heavy[ancestors[j]] {
+				next = append(next, hh)
+			}
+		}
+		for _, hh := range res[i] {
+			next = append(next, reported{key: hh.Key, count: hh.Count})
+		}
+		frontier = next
+	}
+	return res
+}
+
+// Merge folds other into h, level by level, so that h summarizes the union of
+// both streams. Both sketches must use the same hierarchy, and their levels
+// must be compatible as required by Sketch.Merge. Otherwise neither is
+// modified.
+func (h *HierarchicalSketch) Merge(other *HierarchicalSketch) error {
+	if len(h.levels) != len(other.levels) {
+		return incompatibleSketches
+	}
+	for i, sk := range h.levels {
+		if !sk.compatible(&other.levels[i].GenericSketch) {
+			return incompatibleSketches
+		}
+	}
+
+	for i, sk := range h.levels {
+		if err := sk.Merge(other.levels[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Marshal serializes the sketch, with each level marshalled by Sketch.Marshal.
+// The hierarchy itself is not serialized.
+func (h *HierarchicalSketch) Marshal() ([]byte, error) {
+	tmp := &msgp.Hierarchy{Levels: make([][]byte, len(h.levels))}
+	for i, sk := range h.levels {
+		p, err := sk.Marshal()
+		if err != nil {
+			return nil, err
+		}
+		tmp.Levels[i] = p
+	}
+	return tmp.MarshalMsg(nil)
+}
+
+// Unmarshal deserializes a sketch marshalled by Marshal into h, which must
+// have been created with the same hierarchy.
+func (h *HierarchicalSketch) Unmarshal(p []byte) error {
+	tmp := &msgp.Hierarchy{}
+	if _, err := tmp.UnmarshalMsg(p); err != nil {
+		return err
+	}
+	if len(tmp.Levels) != len(h.levels) {
+		return errors.New("topkapi: marshalled sketch has a different number of levels")
+	}
+
+	levels := make([]*Sketch, len(tmp.Levels))
+	for i, p := range tmp.Levels {
+		levels[i] = &Sketch{}
+		if err := levels[i].Unmarshal(p); err != nil {
+			return err
+		}
+	}
+	h.levels = levels
+	return nil
+}
@@ -0,0 +1,97 @@
+package topkapi
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGeneralizers(t *testing.T) {
+	ip := IPGeneralizer{IPv4: []int{24, 16}, IPv6: []int{64, 48, 32}}
+	for _, tc := range []struct {
+		gen       Generalizer
+		key       string
+		ancestors []string
+	}{
+		{PathGeneralizer{Depth: 3}, "/api/v1/users/42", []string{"/api/v1/users/42", "/api/v1/users/*", "/api/v1/*", "/api/*"}},
+		{PathGeneralizer{Depth: 3}, "/api/v1/", []string{"/api/v1/", "/api/v1/*", "/api/v1/*", "/api/*"}},
+		{PathGeneralizer{Depth: 3}, "/api/v1/users/*", []string{"/api/v1/users/*", "/api/v1/users/*", "/api/v1/*", "/api/*"}},
+		{PathGeneralizer{Depth: 1}, "/", []string{"/", "/*"}},
+		{DomainGeneralizer{Depth: 2}, "api.eu.example.com", []string{"api.eu.example.com", "*.example.com", "*.com"}},
+		{DomainGeneralizer{Depth: 2}, "*.eu.example.com.", []string{"*.eu.example.com.", "*.example.com", "*.com"}},
+		{DomainGeneralizer{Depth: 2}, "localhost", []string{"localhost", "*.localhost", "*.localhost"}},
+		{ip, "10.2.3.4", []string{"10.2.3.4", "10.2.3.0/24", "10.2.0.0/16", ""}},
+		{ip, "10.2.3.0/24", []string{"10.2.3.0/24", "10.2.3.0/24", "10.2.0.0/16", ""}},
+		{ip, "2001:db8:1:2::1", []string{"2001:db8:1:2::1", "2001:db8:1:2::/64", "2001:db8:1::/48", "2001:db8::/32"}},
+		{ip, "foo", []string{"foo", "", "", ""}},
+	} {
+		assert.Equal(t, len(tc.ancestors), tc.gen.Levels(), tc.key)
+		for level, expected := range tc.ancestors {
+			ancestor, ok := tc.gen.Generalize(tc.key, level)
+			assert.Equal(t, expected != "", ok, tc.key)
+			assert.Equal(t, expected, ancestor, tc.key)
+		}
+	}
+}
+
+func TestHierarchicalSketch(t *testing.T) {
+	_, err := NewHierarchical(PathGeneralizer{Depth: -1}, WithDimensions(4, 20000))
+	assert.Error(t, err)
+
+	var paths []string
+	for i := 0; i < 10000; i++ {
+		paths = append(paths, fmt.Sprintf("/api/v1/users/%d", i%1000))
+	}
+	for i := 0; i < 4000; i++ {
+		paths = append(paths, fmt.Sprintf("/api/v2/items/%d", i))
+		paths = append(paths, "/static/app.js")
+	}
+	for i := 0; i < 1000; i++ {
+		paths = append(paths, "/static/app.js", fmt.Sprintf("/static/img/%d.png", i))
+	}
+
+	h, err := NewHierarchical(PathGeneralizer{Depth: 3}, WithDimensions(4, 20000))
+	assert.NoError(t, err)
+	assert.Equal(t, 4, h.Levels())
+	halves := [2]*HierarchicalSketch{}
+	for i := range halves {
+		halves[i], _ = NewHierarchical(PathGeneralizer{Depth: 3}, WithDimensions(4, 20000))
+	}
+	for i, p := range paths {
+		h.Insert(p, 1)
+		halves[i%2].Insert(p, 1)
+	}
+	assert.Equal(t, uint64(len(paths)), h.Total())
+
+	// The users are heavy as a whole, and the rest of the API once they are
+	// discounted, while static files are mostly a single heavy file
+	result := h.Result(3000)
+	assert.Equal(t, [][]HierarchicalHeavyHitter{
+		{{Key: "/static/app.js", Count: 5000, Discounted: 5000}},
+		{{Key: "/api/v1/users/*", Count: 10000, Discounted: 10000}, {Key: "/api/v2/items/*", Count: 4000, Discounted: 4000}},
+		nil,
+		nil,
+	}, result)
+	// Lower thresholds report the images, which account for the rest of the
+	// static files
+	assert.Equal(t, []HierarchicalHeavyHitter{{Key: "/static/img/*", Count: 1000, Discounted: 1000}}, h.Result(1000)[2])
+	assert.Empty(t, h.Result(1000)[3])
+	assert.Equal(t, LocalHeavyHitter{Key: "/api/*", Count: 14000, Lower: 14000, Votes: 4}, h.Level(3).TopK(1)[0])
+
+	assert.NoError(t, halves[0].Merge(halves[1]))
+	assert.Equal(t, result, halves[0].Result(3000))
+
+	p, err := h.Marshal()
+	assert.NoError(t, err)
+	tmp, _ := NewHierarchical(PathGeneralizer{Depth: 3}, WithDimensions(4, 1))
+	assert.NoError(t, tmp.Unmarshal(p))
+	assert.Equal(t, result, tmp.Result(3000))
+	for i := 0; i < h.Levels(); i++ {
+		assertSketchesEqual(t, &h.Level(i).GenericSketch, &tmp.Level(i).GenericSketch)
+	}
+
+	other, _ := NewHierarchical(PathGeneralizer{Depth: 2}, WithDimensions(4, 20000))
+	assert.Equal(t, incompatibleSketches, h.Merge(other))
+	assert.Error(t, other.Unmarshal(p))
+}
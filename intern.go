@@ -0,0 +1,143 @@
+package topkapi
+
+import (
+	"strings"
+	"unsafe"
+)
+
+// interner stores each heavy hitter candidate of a sketch once, so that
+// buckets only need to hold a small index. Keys are reference counted by the
+// buckets holding them, and dropped when the last bucket is taken over.
+//
+// The interner has no index of its own: a key can only be held by the buckets
+// it hashes to, one per row, so the sketch finds out whether a key is held
+// already by looking at those, see GenericSketch.find. Callers must only add
+// keys which are not held yet.
+//
+// Index 0 always holds the zero key, which is what empty buckets hold and is
+// not reference counted.
+type interner[K comparable] struct {
+	entries []entry[K]
+	free    []uint32
+	clone   func(K) K
+}
+
+// entry is a key held by an interner. Its hash and reference count are kept
+// next to it, so that taking over a bucket touches a single entry.
+type entry[K comparable] struct {
+	key  K
+	hash uint64
+	refs uint32
+}
+
+func newInterner[K comparable]() interner[K] {
+	in := interner[K]{
+		entries: make([]entry[K], 1),
+		clone:   func(key K) K { return key },
+	}
+	// String keys are copied, so that they don't pin larger buffers they might
+	// have been sliced from
+	if clone, ok := any(strings.Clone).(func(K) K); ok {
+		in.clone = clone
+	}
+	return in
+}
+
+// key returns the key at idx.
+func (in *interner[K]) key(idx uint32) K {
+	return in.entries[idx].key
+}
+
+// hash returns the hash of the key at idx.
+func (in *interner[K]) hash(idx uint32) uint64 {
+	return in.entries[idx].hash
+}
+
+// acquire adds a copy of key with hash h, which must not be held yet, and
+// returns its index.
+func (in *interner[K]) acquire(key K, h uint64) uint32 {
+	var zero K
+	if key == zero {
+		return 0
+	}
+	return in.add(in.clone(key), h)
+}
+
+// share is like acquire, but never copies key. It is meant for keys already
+// held by another interner, which can be shared safely.
+func (in *interner[K]) share(key K, h uint64) uint32 {
+	var zero K
+	if key == zero {
+		return 0
+	}
+	return in.add(key, h)
+}
+
+// acquireBytes is like acquire for byte slice keys.
+func acquireBytes(in *interner[string], key []byte, h uint64) uint32 {
+	if len(key) == 0 {
+		return 0
+	}
+	return in.add(string(key), h)
+}
+
+// ref takes another reference on the key at idx.
+func (in *interner[K]) ref(idx uint32) {
+	if idx != 0 {
+		in.entries[idx].refs++
+	}
+}
+
+// add adds key with hash h, which must not be held yet, with a single reference.
+func (in *interner[K]) add(key K, h uint64) uint32 {
+	e := entry[K]{key: key, hash: h, refs: 1}
+	if n := len(in.free); n > 0 {
+		idx := in.free[n-1]
+		in.free = in.free[:n-1]
+		in.entries[idx] = e
+		return idx
+	}
+	in.entries = append(in.entries, e)
+	return uint32(len(in.entries) - 1)
+}
+
+// release drops a reference on the key at idx, and removes the key if it
+// was the last one.
+func (in *interner[K]) release(idx uint32) {
+	if idx == 0 {
+		return
+	}
+
+	e := &in.entries[idx]
+	if e.refs--; e.refs == 0 {
+		*e = entry[K]{}
+		in.free = append(in.free, idx)
+	}
+}
+
+// reset drops all keys, keeping the memory allocated for them.
+func (in *interner[K]) reset() {
+	for i := range in.entries {
+		in.entries[i] = entry[K]{}
+	}
+	in.entries = in.entries[:1]
+	in.free = in.free[:0]
+}
+
+// len returns the number of distinct keys held.
+func (in *interner[K]) len() int {
+	return len(in.entries) - len(in.free) - 1
+}
+
+// memoryUsage returns the approximate number of bytes used by the interner,
+// including the data of string keys.
+func (in *interner[K]) memoryUsage() uint64 {
+	size := uint64(cap(in.entries))*uint64(unsafe.Sizeof(entry[K]{})) + uint64(cap(in.free))*4
+
+	if entries, ok := any(in.entries).([]entry[string]); ok {
+		for _, e := range entries {
+			size += uint64(len(e.key))
+		}
+	}
+	return size
+}
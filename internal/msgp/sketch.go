@@ -6,7 +6,22 @@ package msgp
 type Sketch struct {
 	L      uint64 // number of rows
 	B      uint64 // think of this as the k
+	K      uint64 // number of heavy hitters the sketch was sized for, if known
 	CMS    [][]uint64
 	Counts [][]int64
-	Words  [][]string
+	Words  [][]string // keys of each bucket, only in sketches predating Keys
+	Keys   []string   // distinct keys, the first of which is the empty key
+	KeyIdx [][]uint32 // index into Keys of each bucket's key
+	Hash   string     // hash function, empty for sketches predating it
+	Seed   uint64     // seed of the hash function
+	Width  uint8      // width in bits of the counters, zero for sketches predating it
+
+	Total        *uint64 // total count inserted, nil for sketches predating it
+	Conservative bool    // whether the sketch uses conservative updates
+}
+
+// Hierarchy is a hierarchical sketch, made of the marshalled Sketch of each
+// level, from the most specific to the most general.
+type Hierarchy struct {
+	Levels [][]byte
 }
@@ -6,6 +6,148 @@ import (
 	"github.com/tinylib/msgp/msgp"
 )
 
+// DecodeMsg implements msgp.Decodable
+func (z *Hierarchy) DecodeMsg(dc *msgp.Reader) (err error) {
+	var field []byte
+	_ = field
+	var zb0001 uint32
+	zb0001, err = dc.ReadMapHeader()
+	if err != nil {
+		err = msgp.WrapError(err)
+		return
+	}
+	for zb0001 > 0 {
+		zb0001--
+		field, err = dc.ReadMapKeyPtr()
+		if err != nil {
+			err = msgp.WrapError(err)
+			return
+		}
+		switch msgp.UnsafeString(field) {
+		case "Levels":
+			var zb0002 uint32
+			zb0002, err = dc.ReadArrayHeader()
+			if err != nil {
+				err = msgp.WrapError(err, "Levels")
+				return
+			}
+			if cap(z.Levels) >= int(zb0002) {
+				z.Levels = (z.Levels)[:zb0002]
+			} else {
+				z.Levels = make([][]byte, zb0002)
+			}
+			for za0001 := range z.Levels {
+				z.Levels[za0001], err = dc.ReadBytes(z.Levels[za0001])
+				if err != nil {
+					err = msgp.WrapError(err, "Levels", za0001)
+					return
+				}
+			}
+		default:
+			err = dc.Skip()
+			if err != nil {
+				err = msgp.WrapError(err)
+				return
+			}
+		}
+	}
+	return
+}
+
+// EncodeMsg implements msgp.Encodable
+func (z *Hierarchy) EncodeMsg(en *msgp.Writer) (err error) {
+	// map header, size 1
+	// write "Levels"
+	err = en.Append(0x81, 0xa6, 0x4c, 0x65, 0x76, 0x65, 0x6c, 0x73)
+	if err != nil {
+		return
+	}
+	err = en.WriteArrayHeader(uint32(len(z.Levels)))
+	if err != nil {
+		err = msgp.WrapError(err, "Levels")
+		return
+	}
+	for za0001 := range z.Levels {
+		err = en.WriteBytes(z.Levels[za0001])
+		if err != nil {
+			err = msgp.WrapError(err, "Levels", za0001)
+			return
+		}
+	}
+	return
+}
+
+// MarshalMsg implements msgp.Marshaler
+func (z *Hierarchy) MarshalMsg(b []byte) (o []byte, err error) {
+	o = msgp.Require(b, z.Msgsize())
+	// map header, size 1
+	// string "Levels"
+	o = append(o, 0x81, 0xa6, 0x4c, 0x65, 0x76, 0x65, 0x6c, 0x73)
+	o = msgp.AppendArrayHeader(o, uint32(len(z.Levels)))
+	for za0001 := range z.Levels {
+		o = msgp.AppendBytes(o, z.Levels[za0001])
+	}
+	return
+}
+
+// UnmarshalMsg implements msgp.Unmarshaler
+func (z *Hierarchy) UnmarshalMsg(bts []byte) (o []byte, err error) {
+	var field []byte
+	_ = field
+	var zb0001 uint32
+	zb0001, bts, err = msgp.ReadMapHeaderBytes(bts)
+	if err != nil {
+		err = msgp.WrapError(err)
+		return
+	}
+	for zb0001 > 0 {
+		zb0001--
+		field, bts, err = msgp.ReadMapKeyZC(bts)
+		if err != nil {
+			err = msgp.WrapError(err)
+			return
+		}
+		switch msgp.UnsafeString(field) {
+		case "Levels":
+			var zb0002 uint32
+			zb0002, bts, err = msgp.ReadArrayHeaderBytes(bts)
+			if err != nil {
+				err = msgp.WrapError(err, "Levels")
+				return
+			}
+			if cap(z.Levels) >= int(zb0002) {
+				z.Levels = (z.Levels)[:zb0002]
+			} else {
+				z.Levels = make([][]byte, zb0002)
+			}
+			for za0001 := range z.Levels {
+				z.Levels[za0001], bts, err = msgp.ReadBytesBytes(bts, z.Levels[za0001])
+				if err != nil {
+					err = msgp.WrapError(err, "Levels", za0001)
+					return
+				}
+			}
+		default:
+			bts, err = msgp.Skip(bts)
+			if err != nil {
+				err = msgp.WrapError(err)
+				return
+			}
+		}
+	}
+	o = bts
+	return
+}
+
+// Msgsize returns an upper bound estimate of the number of bytes occupied by the serialized message
+func (z *Hierarchy) Msgsize() (s int) {
+	s = 1 + 7 + msgp.ArrayHeaderSize
+	for za0001 := range z.Levels {
+		s += msgp.BytesPrefixSize + len(z.Levels[za0001])
+	}
+	return
+}
+
 // DecodeMsg implements msgp.Decodable
 func (z *Sketch) DecodeMsg(dc *msgp.Reader) (err error) {
 	var field []byte
@@ -36,6 +178,12 @@ func (z *Sketch) DecodeMsg(dc *msgp.Reader) (err error) {
 				err = msgp.WrapError(err, "B")
 				return
 			}
+		case "K":
+			z.K, err = dc.ReadUint64()
+			if err != nil {
+				err = msgp.WrapError(err, "K")
+				return
+			}
 		case "CMS":
 			var zb0002 uint32
 			zb0002, err = dc.ReadArrayHeader()
@@ -132,6 +280,99 @@ func (z *Sketch) DecodeMsg(dc *msgp.Reader) (err error) {
 					}
 				}
 			}
+		case "Keys":
+			var zb0008 uint32
+			zb0008, err = dc.ReadArrayHeader()
+			if err != nil {
+				err = msgp.WrapError(err, "Keys")
+				return
+			}
+			if cap(z.Keys) >= int(zb0008) {
+				z.Keys = (z.Keys)[:zb0008]
+			} else {
+				z.Keys = make([]string, zb0008)
+			}
+			for za0007 := range z.Keys {
+				z.Keys[za0007], err = dc.ReadString()
+				if err != nil {
+					err = msgp.WrapError(err, "Keys", za0007)
+					return
+				}
+			}
+		case "KeyIdx":
+			var zb0009 uint32
+			zb0009, err = dc.ReadArrayHeader()
+			if err != nil {
+				err = msgp.WrapError(err, "KeyIdx")
+				return
+			}
+			if cap(z.KeyIdx) >= int(zb0009) {
+				z.KeyIdx = (z.KeyIdx)[:zb0009]
+			} else {
+				z.KeyIdx = make([][]uint32, zb0009)
+			}
+			for za0008 := range z.KeyIdx {
+				var zb0010 uint32
+				zb0010, err = dc.ReadArrayHeader()
+				if err != nil {
+					err = msgp.WrapError(err, "KeyIdx", za0008)
+					return
+				}
+				if cap(z.KeyIdx[za0008]) >= int(zb0010) {
+					z.KeyIdx[za0008] = (z.KeyIdx[za0008])[:zb0010]
+				} else {
+					z.KeyIdx[za0008] = make([]uint32, zb0010)
+				}
+				for za0009 := range z.KeyIdx[za0008] {
+					z.KeyIdx[za0008][za0009], err = dc.ReadUint32()
+					if err != nil {
+						err = msgp.WrapError(err, "KeyIdx", za0008, za0009)
+						return
+					}
+				}
+			}
+		case "Hash":
+			z.Hash, err = dc.ReadString()
+			if err != nil {
+				err = msgp.WrapError(err, "Hash")
+				return
+			}
+		case "Seed":
+			z.Seed, err = dc.ReadUint64()
+			if err != nil {
+				err = msgp.WrapError(err, "Seed")
+				return
+			}
+		case "Width":
+			z.Width, err = dc.ReadUint8()
+			if err != nil {
+				err = msgp.WrapError(err, "Width")
+				return
+			}
+		case "Total":
+			if dc.IsNil() {
+				err = dc.ReadNil()
+				if err != nil {
+					err = msgp.WrapError(err, "Total")
+					return
+				}
+				z.Total = nil
+			} else {
+				if z.Total == nil {
+					z.Total = new(uint64)
+				}
+				*z.Total, err = dc.ReadUint64()
+				if err != nil {
+					err = msgp.WrapError(err, "Total")
+					return
+				}
+			}
+		case "Conservative":
+			z.Conservative, err = dc.ReadBool()
+			if err != nil {
+				err = msgp.WrapError(err, "Conservative")
+				return
+			}
 		default:
 			err = dc.Skip()
 			if err != nil {
@@ -145,9 +386,9 @@ func (z *Sketch) DecodeMsg(dc *msgp.Reader) (err error) {
 
 // EncodeMsg implements msgp.Encodable
 func (z *Sketch) EncodeMsg(en *msgp.Writer) (err error) {
-	// map header, size 5
+	// map header, size 13
 	// write "L"
-	err = en.Append(0x85, 0xa1, 0x4c)
+	err = en.Append(0x8d, 0xa1, 0x4c)
 	if err != nil {
 		return
 	}
@@ -166,6 +407,16 @@ func (z *Sketch) EncodeMsg(en *msgp.Writer) (err error) {
 		err = msgp.WrapError(err, "B")
 		return
 	}
+	// write "K"
+	err = en.Append(0xa1, 0x4b)
+	if err != nil {
+		return
+	}
+	err = en.WriteUint64(z.K)
+	if err != nil {
+		err = msgp.WrapError(err, "K")
+		return
+	}
 	// write "CMS"
 	err = en.Append(0xa3, 0x43, 0x4d, 0x53)
 	if err != nil {
@@ -238,19 +489,120 @@ func (z *Sketch) EncodeMsg(en *msgp.Writer) (err error) {
 			}
 		}
 	}
+	// write "Keys"
+	err = en.Append(0xa4, 0x4b, 0x65, 0x79, 0x73)
+	if err != nil {
+		return
+	}
+	err = en.WriteArrayHeader(uint32(len(z.Keys)))
+	if err != nil {
+		err = msgp.WrapError(err, "Keys")
+		return
+	}
+	for za0007 := range z.Keys {
+		err = en.WriteString(z.Keys[za0007])
+		if err != nil {
+			err = msgp.WrapError(err, "Keys", za0007)
+			return
+		}
+	}
+	// write "KeyIdx"
+	err = en.Append(0xa6, 0x4b, 0x65, 0x79, 0x49, 0x64, 0x78)
+	if err != nil {
+		return
+	}
+	err = en.WriteArrayHeader(uint32(len(z.KeyIdx)))
+	if err != nil {
+		err = msgp.WrapError(err, "KeyIdx")
+		return
+	}
+	for za0008 := range z.KeyIdx {
+		err = en.WriteArrayHeader(uint32(len(z.KeyIdx[za0008])))
+		if err != nil {
+			err = msgp.WrapError(err, "KeyIdx", za0008)
+			return
+		}
+		for za0009 := range z.KeyIdx[za0008] {
+			err = en.WriteUint32(z.KeyIdx[za0008][za0009])
+			if err != nil {
+				err = msgp.WrapError(err, "KeyIdx", za0008, za0009)
+				return
+			}
+		}
+	}
+	// write "Hash"
+	err = en.Append(0xa4, 0x48, 0x61, 0x73, 0x68)
+	if err != nil {
+		return
+	}
+	err = en.WriteString(z.Hash)
+	if err != nil {
+		err = msgp.WrapError(err, "Hash")
+		return
+	}
+	// write "Seed"
+	err = en.Append(0xa4, 0x53, 0x65, 0x65, 0x64)
+	if err != nil {
+		return
+	}
+	err = en.WriteUint64(z.Seed)
+	if err != nil {
+		err = msgp.WrapError(err, "Seed")
+		return
+	}
+	// write "Width"
+	err = en.Append(0xa5, 0x57, 0x69, 0x64, 0x74, 0x68)
+	if err != nil {
+		return
+	}
+	err = en.WriteUint8(z.Width)
+	if err != nil {
+		err = msgp.WrapError(err, "Width")
+		return
+	}
+	// write "Total"
+	err = en.Append(0xa5, 0x54, 0x6f, 0x74, 0x61, 0x6c)
+	if err != nil {
+		return
+	}
+	if z.Total == nil {
+		err = en.WriteNil()
+		if err != nil {
+			return
+		}
+	} else {
+		err = en.WriteUint64(*z.Total)
+		if err != nil {
+			err = msgp.WrapError(err, "Total")
+			return
+		}
+	}
+	// write "Conservative"
+	err = en.Append(0xac, 0x43, 0x6f, 0x6e, 0x73, 0x65, 0x72, 0x76, 0x61, 0x74, 0x69, 0x76, 0x65)
+	if err != nil {
+		return
+	}
+	err = en.WriteBool(z.Conservative)
+	if err != nil {
+		err = msgp.WrapError(err, "Conservative")
+		return
+	}
 	return
 }
 
 // MarshalMsg implements msgp.Marshaler
 func (z *Sketch) MarshalMsg(b []byte) (o []byte, err error) {
 	o = msgp.Require(b, z.Msgsize())
-	// map header, size 5
+	// map header, size 13
 	// string "L"
-	o = append(o, 0x85, 0xa1, 0x4c)
+	o = append(o, 0x8d, 0xa1, 0x4c)
 	o = msgp.AppendUint64(o, z.L)
 	// string "B"
 	o = append(o, 0xa1, 0x42)
 	o = msgp.AppendUint64(o, z.B)
+	// string "K"
+	o = append(o, 0xa1, 0x4b)
+	o = msgp.AppendUint64(o, z.K)
 	// string "CMS"
 	o = append(o, 0xa3, 0x43, 0x4d, 0x53)
 	o = msgp.AppendArrayHeader(o, uint32(len(z.CMS)))
@@ -278,6 +630,40 @@ func (z *Sketch) MarshalMsg(b []byte) (o []byte, err error) {
 			o = msgp.AppendString(o, z.Words[za0005][za0006])
 		}
 	}
+	// string "Keys"
+	o = append(o, 0xa4, 0x4b, 0x65, 0x79, 0x73)
+	o = msgp.AppendArrayHeader(o, uint32(len(z.Keys)))
+	for za0007 := range z.Keys {
+		o = msgp.AppendString(o, z.Keys[za0007])
+	}
+	// string "KeyIdx"
+	o = append(o, 0xa6, 0x4b, 0x65, 0x79, 0x49, 0x64, 0x78)
+	o = msgp.AppendArrayHeader(o, uint32(len(z.KeyIdx)))
+	for za0008 := range z.KeyIdx {
+		o = msgp.AppendArrayHeader(o, uint32(len(z.KeyIdx[za0008])))
+		for za0009 := range z.KeyIdx[za0008] {
+			o = msgp.AppendUint32(o, z.KeyIdx[za0008][za0009])
+		}
+	}
+	// string "Hash"
+	o = append(o, 0xa4, 0x48, 0x61, 0x73, 0x68)
+	o = msgp.AppendString(o, z.Hash)
+	// string "Seed"
+	o = append(o, 0xa4, 0x53, 0x65, 0x65, 0x64)
+	o = msgp.AppendUint64(o, z.Seed)
+	// string "Width"
+	o = append(o, 0xa5, 0x57, 0x69, 0x64, 0x74, 0x68)
+	o = msgp.AppendUint8(o, z.Width)
+	// string "Total"
+	o = append(o, 0xa5, 0x54, 0x6f, 0x74, 0x61, 0x6c)
+	if z.Total == nil {
+		o = msgp.AppendNil(o)
+	} else {
+		o = msgp.AppendUint64(o, *z.Total)
+	}
+	// string "Conservative"
+	o = append(o, 0xac, 0x43, 0x6f, 0x6e, 0x73, 0x65, 0x72, 0x76, 0x61, 0x74, 0x69, 0x76, 0x65)
+	o = msgp.AppendBool(o, z.Conservative)
 	return
 }
 
@@ -311,6 +697,12 @@ func (z *Sketch) UnmarshalMsg(bts []byte) (o []byte, err error) {
 				err = msgp.WrapError(err, "B")
 				return
 			}
+		case "K":
+			z.K, bts, err = msgp.ReadUint64Bytes(bts)
+			if err != nil {
+				err = msgp.WrapError(err, "K")
+				return
+			}
 		case "CMS":
 			var zb0002 uint32
 			zb0002, bts, err = msgp.ReadArrayHeaderBytes(bts)
@@ -407,6 +799,98 @@ func (z *Sketch) UnmarshalMsg(bts []byte) (o []byte, err error) {
 					}
 				}
 			}
+		case "Keys":
+			var zb0008 uint32
+			zb0008, bts, err = msgp.ReadArrayHeaderBytes(bts)
+			if err != nil {
+				err = msgp.WrapError(err, "Keys")
+				return
+			}
+			if cap(z.Keys) >= int(zb0008) {
+				z.Keys = (z.Keys)[:zb0008]
+			} else {
+				z.Keys = make([]string, zb0008)
+			}
+			for za0007 := range z.Keys {
+				z.Keys[za0007], bts, err = msgp.ReadStringBytes(bts)
+				if err != nil {
+					err = msgp.WrapError(err, "Keys", za0007)
+					return
+				}
+			}
+		case "KeyIdx":
+			var zb0009 uint32
+			zb0009, bts, err = msgp.ReadArrayHeaderBytes(bts)
+			if err != nil {
+				err = msgp.WrapError(err, "KeyIdx")
+				return
+			}
+			if cap(z.KeyIdx) >= int(zb0009) {
+				z.KeyIdx = (z.KeyIdx)[:zb0009]
+			} else {
+				z.KeyIdx = make([][]uint32, zb0009)
+			}
+			for za0008 := range z.KeyIdx {
+				var zb0010 uint32
+				zb0010, bts, err = msgp.ReadArrayHeaderBytes(bts)
+				if err != nil {
+					err = msgp.WrapError(err, "KeyIdx", za0008)
+					return
+				}
+				if cap(z.KeyIdx[za0008]) >= int(zb0010) {
+					z.KeyIdx[za0008] = (z.KeyIdx[za0008])[:zb0010]
+				} else {
+					z.KeyIdx[za0008] = make([]uint32, zb0010)
+				}
+				for za0009 := range z.KeyIdx[za0008] {
+					z.KeyIdx[za0008][za0009], bts, err = msgp.ReadUint32Bytes(bts)
+					if err != nil {
+						err = msgp.WrapError(err, "KeyIdx", za0008, za0009)
+						return
+					}
+				}
+			}
+		case "Hash":
+			z.Hash, bts, err = msgp.ReadStringBytes(bts)
+			if err != nil {
+				err = msgp.WrapError(err, "Hash")
+				return
+			}
+		case "Seed":
+			z.Seed, bts, err = msgp.ReadUint64Bytes(bts)
+			if err != nil {
+				err = msgp.WrapError(err, "Seed")
+				return
+			}
+		case "Width":
+			z.Width, bts, err = msgp.ReadUint8Bytes(bts)
+			if err != nil {
+				err = msgp.WrapError(err, "Width")
+				return
+			}
+		case "Total":
+			if msgp.IsNil(bts) {
+				bts, err = msgp.ReadNilBytes(bts)
+				if err != nil {
+					return
+				}
+				z.Total = nil
+			} else {
+				if z.Total == nil {
+					z.Total = new(uint64)
+				}
+				*z.Total, bts, err = msgp.ReadUint64Bytes(bts)
+				if err != nil {
+					err = msgp.WrapError(err, "Total")
+					return
+				}
+			}
+		case "Conservative":
+			z.Conservative, bts, err = msgp.ReadBoolBytes(bts)
+			if err != nil {
+				err = msgp.WrapError(err, "Conservative")
+				return
+			}
 		default:
 			bts, err = msgp.Skip(bts)
 			if err != nil {
@@ -421,7 +905,7 @@ func (z *Sketch) UnmarshalMsg(bts []byte) (o []byte, err error) {
 
 // Msgsize returns an upper bound estimate of the number of bytes occupied by the serialized message
 func (z *Sketch) Msgsize() (s int) {
-	s = 1 + 2 + msgp.Uint64Size + 2 + msgp.Uint64Size + 4 + msgp.ArrayHeaderSize
+	s = 1 + 2 + msgp.Uint64Size + 2 + msgp.Uint64Size + 2 + msgp.Uint64Size + 4 + msgp.ArrayHeaderSize
 	for za0001 := range z.CMS {
 		s += msgp.ArrayHeaderSize + (len(z.CMS[za0001]) * (msgp.Uint64Size))
 	}
@@ -436,5 +920,20 @@ func (z *Sketch) Msgsize() (s int) {
 			s += msgp.StringPrefixSize + len(z.Words[za0005][za0006])
 		}
 	}
+	s += 5 + msgp.ArrayHeaderSize
+	for za0007 := range z.Keys {
+		s += msgp.StringPrefixSize + len(z.Keys[za0007])
+	}
+	s += 7 + msgp.ArrayHeaderSize
+	for za0008 := range z.KeyIdx {
+		s += msgp.ArrayHeaderSize + (len(z.KeyIdx[za0008]) * (msgp.Uint32Size))
+	}
+	s += 5 + msgp.StringPrefixSize + len(z.Hash) + 5 + msgp.Uint64Size + 6 + msgp.Uint8Size + 6
+	if z.Total == nil {
+		s += msgp.NilSize
+	} else {
+		s += msgp.Uint64Size
+	}
+	s += 13 + msgp.BoolSize
 	return
 }
@@ -0,0 +1,447 @@
+package topkapi
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+	"unsafe"
+)
+
+// defaultRows is the number of rows of sketches whose delta is not given.
+const defaultRows = 4
+
+// maxBudgetRows is the most rows WithMemoryBudget sizes a sketch with. More
+// rows cost insert time for little gain in practice.
+const maxBudgetRows = 6
+
+// stringSize is the size of a string header, which is what the buckets of a
+// sketch over string keys hold.
+const stringSize = uint64(unsafe.Sizeof(""))
+
+// bucketSize returns the size in bytes of a bucket in the worst case of every
+// bucket holding a distinct key of keySize bytes, retaining keyLen bytes of
+// key data.
+func bucketSize(width int, keySize, keyLen uint64) uint64 {
+	return bucketBytes(width) + keySize + 8 + 4 + keyLen
+}
+
+// Option configures a sketch created by one of the constructors of this package.
+type Option func(*options) error
+
+// Options that only apply to some kinds of sketches. Constructors reject them
+// unless they are allowed, see options.only.
+const (
+	clockOption = 1 << iota
+	emitOptions
+)
+
+type options struct {
+	special int // options above that were given
+
+	hash    HashFunc
+	seed    uint64
+	hashSet bool
+
+	k            uint64
+	corpusSize   uint64
+	epsilon      float64
+	delta        float64
+	memoryBudget uint64
+	avgKeyLen    uint64
+	rows         uint64
+	buckets      uint64
+	width        int
+	conservative bool
+	clock        func() time.Time
+
+	emitEvery     uint64
+	emitInterval  time.Duration
+	emitThreshold uint64
+	emitTopK      int
+}
+
+func newOptions(opts []Option) (*options, error) {
+	o := &options{
+		hash:  Metro,
+		seed:  DefaultSeed,
+		width: 64,
+		clock: time.Now,
+
+		emitThreshold: 1,
+	}
+	for _, opt := range opts {
+		if err := opt(o); err != nil {
+			return nil, err
+		}
+	}
+	return o, nil
+}
+
+// only returns an error if any of the options that only apply to some kinds
+// of sketches was given, other than those in allowed.
+func (o *options) only(allowed int) error {
+	switch extra := o.special &^ allowed; {
+	case extra&clockOption != 0:
+		return errors.New("topkapi: clock only applies to WindowedSketch and TumblingSketch")
+	case extra&emitOptions != 0:
+		return errors.New("topkapi: emit options only apply to TumblingSketch")
+	}
+	return nil
+}
+
+// hasher returns the hasher for string keys configured by o.
+func (o *options) hasher() (Hasher[string], error) {
+	return newStringHasher(o.hash, o.seed)
+}
+
+// dimensions validates the combination of options and returns the number of
+// buckets and rows they result in for keys of keySize bytes.
+func (o *options) dimensions(keySize uint64) (b, l uint64, err error) {
+	var sources int
+	for _, set := range []bool{o.epsilon != 0, o.corpusSize != 0, o.memoryBudget != 0, o.buckets != 0} {
+		if set {
+			sources++
+		}
+	}
+	switch {
+	case sources == 0:
+		return 0, 0, errors.New("topkapi: one of epsilon, k with corpus size, memory budget or dimensions is required")
+	case sources > 1:
+		return 0, 0, errors.New("topkapi: only one of epsilon, k with corpus size, memory budget or dimensions may be given")
+	case o.corpusSize != 0 && o.k == 0:
+		return 0, 0, errors.New("topkapi: corpus size requires k")
+	case o.buckets != 0 && o.delta != 0:
+		return 0, 0, errors.New("topkapi: delta cannot be combined with dimensions")
+	case o.avgKeyLen != 0 && o.memoryBudget == 0:
+		return 0, 0, errors.New("topkapi: average key length requires a memory budget")
+	}
+
+	l = defaultRows
+	if o.rows != 0 {
+		l = o.rows
+	} else if o.delta != 0 {
+		l = uint64(math.Log(2 / o.delta))
+		if l < 1 {
+			l = 1
+		}
+	} else if o.memoryBudget != 0 {
+		l = budgetRows(o.memoryBudget / bucketSize(o.width, keySize, o.avgKeyLen))
+	}
+
+	switch {
+	case o.buckets != 0:
+		b = o.buckets
+	case o.epsilon != 0:
+		b = uint64(math.Ceil(1 / o.epsilon))
+	case o.corpusSize != 0:
+		// We want to grow ~ k*log(corpus size)
+		// The factor 55 was chosen through experiementation as the minimal threshold where
+		// the error rates don't grow out of control on merge and our tests pass.
+		// Example: for top-20 on a corpus of 1M we require 15197 buckets and ~475kb space.
+		b = uint64(55.0 * float64(o.k) * math.Log(float64(o.corpusSize)))
+	case o.memoryBudget != 0:
+		b = o.memoryBudget / (l * bucketSize(o.width, keySize, o.avgKeyLen))
+	}
+	if b < 1 {
+		return 0, 0, fmt.Errorf("topkapi: options result in a sketch without buckets (%d rows)", l)
+	}
+
+	return b, l, nil
+}
+
+// budgetRows returns the number of rows that gives the best accuracy for a
+// sketch of the given number of buckets in total. The rows are split such
+// that the probability of exceeding the error bound, 2/e^l, is no more than
+// the error factor l/buckets, up to maxBudgetRows.
+func budgetRows(buckets uint64) uint64 {
+	l := uint64(1)
+	for ; l < maxBudgetRows; l++ {
+		if 2/math.Exp(float64(l)) <= float64(l)/float64(buckets) {
+			break
+		}
+	}
+	return l
+}
+
+// NewWithOptions creates a sketch configured by opts. The number of buckets
+// is determined by exactly one of WithEpsilon, WithK together with
+// WithCorpusSize, WithMemoryBudget or WithDimensions. The number of rows is
+// determined by WithDelta or WithDimensions, and defaults to 4.
+//
+// The resulting dimensions are reported by Sketch.Dimensions. Options that
+// only apply to other kinds of sketches, such as WithClock and WithEmitEvery,
+// are rejected.
+func NewWithOptions(opts ...Option) (*Sketch, error) {
+	o, err := newOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := o.only(0); err != nil {
+		return nil, err
+	}
+	return o.sketch()
+}
+
+// sketch creates a sketch over string keys configured by o.
+func (o *options) sketch() (*Sketch, error) {
+	b, l, err := o.dimensions(stringSize)
+	if err != nil {
+		return nil, err
+	}
+	hasher, err := o.hasher()
+	if err != nil {
+		return nil, err
+	}
+
+	sk := &Sketch{*newGenericSketch(b, l, o.width, hasher)}
+	sk.k = o.k
+	sk.conservative = o.conservative
+	return sk, nil
+}
+
+// NewGenericWithOptions is like NewWithOptions, but creates a sketch over keys
+// of type K which are hashed with hasher. WithHash and WithSeed cannot be used
+// with it, as they only configure the hasher for string keys.
+func NewGenericWithOptions[K comparable](hasher Hasher[K], opts ...Option) (*GenericSketch[K], error) {
+	o, err := newOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := o.only(0); err != nil {
+		return nil, err
+	}
+	if o.hashSet {
+		return nil, errors.New("topkapi: hash options cannot be used with an explicit hasher")
+	}
+	var zero K
+	b, l, err := o.dimensions(uint64(unsafe.Sizeof(zero)))
+	if err != nil {
+		return nil, err
+	}
+
+	sk := newGenericSketch(b, l, o.width, hasher)
+	sk.k = o.k
+	sk.conservative = o.conservative
+	return sk, nil
+}
+
+// WithK sets the number of heavy hitters the sketch is sized for, which is
+// also the number of keys returned by Top.
+func WithK(k uint64) Option {
+	return func(o *options) error {
+		if k < 1 {
+			return errors.New("topkapi: value of k should be in >= 1")
+		}
+		o.k = k
+		return nil
+	}
+}
+
+// WithCorpusSize sizes the sketch for finding the top k keys in a corpus of
+// approximately the given size. It requires WithK.
+func WithCorpusSize(approxCorpusSize uint64) Option {
+	return func(o *options) error {
+		if approxCorpusSize < 2 {
+			return errors.New("topkapi: value of corpus size should be >= 2")
+		}
+		o.corpusSize = approxCorpusSize
+		return nil
+	}
+}
+
+// WithEpsilon sizes the sketch so that counts exceed the true count by at
+// most a factor of epsilon of the total count.
+func WithEpsilon(epsilon float64) Option {
+	return func(o *options) error {
+		if epsilon <= 0 || epsilon >= 1 {
+			return errors.New("topkapi: value of epsilon should be in range of (0, 1)")
+		}
+		o.epsilon = epsilon
+		return nil
+	}
+}
+
+// WithDelta sizes the sketch so that counts are outside the error range
+// given by epsilon with a probability of at most delta.
+func WithDelta(delta float64) Option {
+	return func(o *options) error {
+		if delta <= 0 || delta >= 1 {
+			return errors.New("topkapi: value of delta should be in range of (0, 1)")
+		}
+		o.delta = delta
+		return nil
+	}
+}
+
+// NewWithMemoryBudget creates a sketch using at most the given number of
+// bytes, including the keys retained in its buckets, which are assumed to be
+// avgKeyLen bytes long on average. See WithMemoryBudget for details.
+func NewWithMemoryBudget(bytes, avgKeyLen uint64, opts ...Option) (*Sketch, error) {
+	return NewWithOptions(append([]Option{WithMemoryBudget(bytes), WithAvgKeyLength(avgKeyLen)}, opts...)...)
+}
+
+// WithMemoryBudget sizes the sketch to use at most the given number of bytes
+// for its buckets, including the keys retained in them if their length is
+// given by WithAvgKeyLength. Unless WithDelta is given, the budget is split
+// between rows and buckets for the best accuracy.
+func WithMemoryBudget(bytes uint64) Option {
+	return func(o *options) error {
+		if bytes == 0 {
+			return errors.New("topkapi: memory budget should be > 0")
+		}
+		o.memoryBudget = bytes
+		return nil
+	}
+}
+
+// WithAvgKeyLength sets the average length of keys for WithMemoryBudget. In
+// the worst case every bucket retains a distinct key.
+func WithAvgKeyLength(n uint64) Option {
+	return func(o *options) error {
+		o.avgKeyLen = n
+		return nil
+	}
+}
+
+// WithDimensions sets the number of rows and buckets per row explicitly.
+func WithDimensions(rows, buckets uint64) Option {
+	return func(o *options) error {
+		if rows < 1 || buckets < 1 {
+			return errors.New("topkapi: rows and buckets should be >= 1")
+		}
+		o.rows, o.buckets = rows, buckets
+		return nil
+	}
+}
+
+// WithCounterWidth sets the width in bits of the sketch's counters, which may
+// be 16, 32 or the default 64. Narrower counters make sketches of streams with
+// low counts considerably smaller. Counters never overflow: as soon as any of
+// them would, the counters of all buckets are promoted to the next wider
+// width, which is what Marshal records.
+func WithCounterWidth(bits int) Option {
+	return func(o *options) error {
+		if !validWidth(bits) {
+			return fmt.Errorf("topkapi: counter width must be 16, 32 or 64, not %d", bits)
+		}
+		o.width = bits
+		return nil
+	}
+}
+
+// WithConservativeUpdate makes inserts raise the count-min counter of each row
+// only as far as the key's new estimate, the smallest counter of its rows plus
+// the count inserted, rather than adding the count to every row. Counts stay
+// upper bounds of the true counts but are considerably tighter, notably for
+// keys of medium frequency.
+//
+// Conservative updates take an extra pass over the rows. Sketches with
+// conservative updates cannot be merged with standard ones, see Merge.
+func WithConservativeUpdate() Option {
+	return func(o *options) error {
+		o.conservative = true
+		return nil
+	}
+}
+
+// WithSeed sets the seed of the hash function. Sketches can only be merged
+// if they use the same seed.
+func WithSeed(seed uint64) Option {
+	return func(o *options) error {
+		o.seed = seed
+		o.hashSet = true
+		return nil
+	}
+}
+
+// WithRandomSeed seeds the hash function with a cryptographically random
+// seed, which makes it infeasible for an attacker to craft colliding keys.
+// Sketches that need to be merged must share a seed, so for sketches built in
+// different processes use WithSeed with a secret seed instead.
+func WithRandomSeed() Option {
+	return func(o *options) error {
+		var p [8]byte
+		if _, err := rand.Read(p[:]); err != nil {
+			return fmt.Errorf("topkapi: generating random seed: %w", err)
+		}
+		o.seed = binary.LittleEndian.Uint64(p[:])
+		o.hashSet = true
+		return nil
+	}
+}
+
+// WithHash sets the hash function used for string keys. The default is Metro.
+func WithHash(fn HashFunc) Option {
+	return func(o *options) error {
+		if _, err := newStringHasher(fn, 0); err != nil {
+			return err
+		}
+		o.hash = fn
+		o.hashSet = true
+		return nil
+	}
+}
+
+// WithClock sets the clock that a WindowedSketch or TumblingSketch reads the
+// current time from. The default is time.Now. Other constructors reject it.
+func WithClock(now func() time.Time) Option {
+	return func(o *options) error {
+		if now == nil {
+			return errors.New("topkapi: clock must not be nil")
+		}
+		o.clock = now
+		o.special |= clockOption
+		return nil
+	}
+}
+
+// WithEmitEvery makes a TumblingSketch emit its window after every n inserts.
+// Like the other emit options, it is rejected by other constructors.
+func WithEmitEvery(n uint64) Option {
+	return func(o *options) error {
+		if n == 0 {
+			return errors.New("topkapi: windows need at least one insert")
+		}
+		o.emitEvery = n
+		o.special |= emitOptions
+		return nil
+	}
+}
+
+// WithEmitInterval makes a TumblingSketch emit its window every d, as
+// measured by the clock set with WithClock.
+func WithEmitInterval(d time.Duration) Option {
+	return func(o *options) error {
+		if d <= 0 {
+			return errors.New("topkapi: interval must be positive")
+		}
+		o.emitInterval = d
+		o.special |= emitOptions
+		return nil
+	}
+}
+
+// WithEmitThreshold makes a TumblingSketch report the Result of each window
+// for the given threshold. This is the default, with a threshold of 1.
+func WithEmitThreshold(threshold uint64) Option {
+	return func(o *options) error {
+		o.emitThreshold, o.emitTopK = threshold, 0
+		o.special |= emitOptions
+		return nil
+	}
+}
+
+// WithEmitTopK makes a TumblingSketch report the TopK of each window.
+func WithEmitTopK(k int) Option {
+	return func(o *options) error {
+		if k <= 0 {
+			return errors.New("topkapi: k must be positive")
+		}
+		o.emitThreshold, o.emitTopK = 0, k
+		o.special |= emitOptions
+		return nil
+	}
+}
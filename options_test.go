@@ -0,0 +1,173 @@
+package topkapi
+
+import (
+	"testing"
+	"time"
+
+	"github.com/axiomhq/topkapi/internal/msgp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHashOptions(t *testing.T) {
+	words := loadWords()
+
+	sketch, err := NewTopK(20, uint64(len(words)), 0.01, WithHash(XXH3), WithSeed(42))
+	assert.NoError(t, err)
+	assert.Equal(t, XXH3Hasher{Seed: 42}, sketch.Hasher())
+	for _, w := range words {
+		sketch.Insert(w, 1)
+	}
+
+	p, err := sketch.Marshal()
+	assert.NoError(t, err)
+
+	tmp := &Sketch{}
+	assert.NoError(t, tmp.Unmarshal(p))
+	assertSketchesEqual(t, &sketch.GenericSketch, &tmp.GenericSketch)
+	top := sketch.Top()[0]
+	count, tracked := tmp.EstimateBytes([]byte(top.Key))
+	assert.True(t, tracked)
+	assert.Equal(t, top.Count, count)
+
+	// Unmarshalling replaces the hasher of sketches over string keys
+	tmp, _ = NewTopK(20, uint64(len(words)), 0.01)
+	assert.NoError(t, tmp.Unmarshal(p))
+	assertSketchesEqual(t, &sketch.GenericSketch, &tmp.GenericSketch)
+
+	other, _ := NewTopK(20, uint64(len(words)), 0.01, WithHash(XXH3))
+	assert.Equal(t, incompatibleSketches, sketch.Merge(other))
+	other, _ = NewTopK(20, uint64(len(words)), 0.01, WithSeed(42))
+	assert.Equal(t, incompatibleSketches, sketch.Merge(other))
+	other, _ = NewTopK(20, uint64(len(words)), 0.01, WithHash(XXH3), WithSeed(42))
+	assert.NoError(t, sketch.Merge(other))
+
+	random1, _ := New(0.01, 0.01, WithRandomSeed())
+	random2, _ := New(0.01, 0.01, WithRandomSeed())
+	assert.NotEqual(t, random1.Hasher(), random2.Hasher())
+	assert.Equal(t, incompatibleSketches, random1.Merge(random2))
+
+	_, err = New(0.01, 0.01, WithHash("nope"))
+	assert.Error(t, err)
+}
+
+func TestUnmarshalHasher(t *testing.T) {
+	// Sketches marshalled before the hasher was persisted use the default
+	p, err := (&msgp.Sketch{L: 1, B: 1, CMS: [][]uint64{{0}}, Counts: [][]int64{{0}}, Words: [][]string{{""}}}).MarshalMsg(nil)
+	assert.NoError(t, err)
+	sketch, _ := New(0.01, 0.01, WithHash(XXH3))
+	assert.NoError(t, sketch.Unmarshal(p))
+	assert.Equal(t, MetroHasher{Seed: DefaultSeed}, sketch.Hasher())
+
+	// Sketches over other keys must be unmarshalled with the same hasher
+	isketch, _ := NewGeneric[int](0.01, 0.01, IntHasher[int]{Seed: 1})
+	p, err = isketch.MarshalWith(IntCodec[int]{})
+	assert.NoError(t, err)
+	tmp, _ := NewGeneric[int](0.01, 0.01, IntHasher[int]{Seed: 2})
+	assert.Equal(t, errHasherMismatch, tmp.UnmarshalWith(p, IntCodec[int]{}))
+	tmp, _ = NewGeneric[int](0.01, 0.01, IntHasher[int]{Seed: 1})
+	assert.NoError(t, tmp.UnmarshalWith(p, IntCodec[int]{}))
+
+	// Custom hashers are kept as is
+	hasher := HasherFunc[int](func(key int) uint64 { return uint64(key) * 0x9e3779b97f4a7c15 })
+	isketch, _ = NewGeneric[int](0.01, 0.01, hasher)
+	p, err = isketch.MarshalWith(IntCodec[int]{})
+	assert.NoError(t, err)
+	tmp, _ = NewGeneric[int](0.01, 0.01, hasher)
+	assert.NoError(t, tmp.UnmarshalWith(p, IntCodec[int]{}))
+	assert.NoError(t, tmp.Merge(isketch))
+
+	// Sketches with different hash functions can't be combined
+	other := HasherFunc[int](func(key int) uint64 { return uint64(key) * 0xbf58476d1ce4e5b9 })
+	tmp, _ = NewGeneric[int](0.01, 0.01, other)
+	assert.Equal(t, incompatibleSketches, tmp.Merge(isketch))
+	assert.Equal(t, incompatibleSketches, tmp.Subtract(isketch))
+}
+
+func TestNewWithOptions(t *testing.T) {
+	cases := []struct {
+		name    string
+		opts    []Option
+		rows    uint64
+		buckets uint64
+		err     bool
+	}{
+		{name: "epsilon", opts: []Option{WithEpsilon(0.001)}, rows: 4, buckets: 1000},
+		{name: "epsilon and delta", opts: []Option{WithEpsilon(0.001), WithDelta(0.01)}, rows: 5, buckets: 1000},
+		{name: "k and corpus size", opts: []Option{WithK(20), WithCorpusSize(1000000)}, rows: 4, buckets: 15197},
+		{name: "memory budget", opts: []Option{WithMemoryBudget(1 << 20)}, rows: 6, buckets: (1 << 20) / (6 * bucketSize(64, stringSize, 0))},
+		{name: "small memory budget", opts: []Option{WithMemoryBudget(1 << 10)}, rows: 3, buckets: (1 << 10) / (3 * bucketSize(64, stringSize, 0))},
+		{name: "memory budget and delta", opts: []Option{WithMemoryBudget(1 << 20), WithDelta(0.001)}, rows: 7, buckets: (1 << 20) / (7 * bucketSize(64, stringSize, 0))},
+		{name: "memory budget and key length", opts: []Option{WithMemoryBudget(1 << 20), WithAvgKeyLength(32)}, rows: 6, buckets: (1 << 20) / (6 * bucketSize(64, stringSize, 32))},
+		{name: "key length only", opts: []Option{WithEpsilon(0.01), WithAvgKeyLength(32)}, err: true},
+		{name: "dimensions", opts: []Option{WithDimensions(3, 100), WithK(10)}, rows: 3, buckets: 100},
+		{name: "nothing", opts: nil, err: true},
+		{name: "k only", opts: []Option{WithK(10)}, err: true},
+		{name: "corpus size only", opts: []Option{WithCorpusSize(1000)}, err: true},
+		{name: "epsilon and memory budget", opts: []Option{WithEpsilon(0.01), WithMemoryBudget(1 << 20)}, err: true},
+		{name: "dimensions and delta", opts: []Option{WithDimensions(3, 100), WithDelta(0.01)}, err: true},
+		{name: "tiny memory budget", opts: []Option{WithMemoryBudget(10)}, err: true},
+		{name: "invalid epsilon", opts: []Option{WithEpsilon(1)}, err: true},
+		{name: "invalid delta", opts: []Option{WithEpsilon(0.01), WithDelta(0)}, err: true},
+		{name: "invalid k", opts: []Option{WithK(0), WithCorpusSize(1000)}, err: true},
+		{name: "invalid dimensions", opts: []Option{WithDimensions(0, 100)}, err: true},
+		{name: "clock", opts: []Option{WithDimensions(3, 100), WithClock(time.Now)}, err: true},
+		{name: "emit every", opts: []Option{WithDimensions(3, 100), WithEmitEvery(100)}, err: true},
+		{name: "emit top k", opts: []Option{WithDimensions(3, 100), WithEmitTopK(10)}, err: true},
+	}
+
+	for _, cas := range cases {
+		t.Run(cas.name, func(t *testing.T) {
+			sketch, err := NewWithOptions(cas.opts...)
+			if cas.err {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			rows, buckets := sketch.Dimensions()
+			assert.Equal(t, cas.rows, rows)
+			assert.Equal(t, cas.buckets, buckets)
+		})
+	}
+}
+
+func TestLegacyConstructors(t *testing.T) {
+	sketch, _ := New(0.01, 0.001)
+	rows, buckets := sketch.Dimensions()
+	assert.Equal(t, uint64(5), rows)
+	assert.Equal(t, uint64(1000), buckets)
+
+	sketch, _ = NewTopK(20, 1000000, 0.01)
+	rows, buckets = sketch.Dimensions()
+	assert.Equal(t, uint64(4), rows)
+	assert.Equal(t, uint64(15197), buckets)
+	assert.Equal(t, uint64(20), sketch.k)
+
+	_, err := NewGenericWithOptions[int](IntHasher[int]{}, WithEpsilon(0.01), WithSeed(1))
+	assert.Error(t, err)
+}
+
+func TestMemoryBudget(t *testing.T) {
+	words := loadWords()
+
+	var keyLen int
+	for _, w := range words {
+		keyLen += len(w)
+	}
+	avgKeyLen := uint64(keyLen / len(words))
+
+	for _, budget := range []uint64{64 << 10, 1 << 20, 4 << 20} {
+		sketch, err := NewWithMemoryBudget(budget, avgKeyLen)
+		assert.NoError(t, err)
+		assert.Less(t, sketch.MemoryUsage(), budget)
+
+		for _, w := range words {
+			sketch.Insert(w, 1)
+		}
+		assert.Less(t, sketch.MemoryUsage(), budget)
+	}
+
+	sketch, _ := NewWithOptions(WithDimensions(2, 10))
+	empty := sketch.MemoryUsage()
+	sketch.Insert("0123456789", 1)
+	assert.GreaterOrEqual(t, sketch.MemoryUsage(), empty+10)
+}
@@ -1,154 +1,670 @@
 package topkapi
 
 import (
+	"container/heap"
 	"errors"
 	"math"
 	"sort"
+	"unsafe"
 
 	"github.com/axiomhq/topkapi/internal/msgp"
-	"github.com/dgryski/go-metro"
 )
 
-var incompatibleSketches = errors.New("Incompatible sketches")
+var (
+	incompatibleSketches = errors.New("Incompatible sketches")
+	errNoCodec           = errors.New("topkapi: a key codec is required to marshal non-string keys")
+	errNoHasher          = errors.New("topkapi: a hasher is required to unmarshal non-string keys")
+	errHasherMismatch    = errors.New("topkapi: hasher does not match the marshalled sketch")
+	errMalformed         = errors.New("topkapi: malformed sketch")
+	errRemoveUnsupported = errors.New("topkapi: sketches with conservative updates do not support Remove")
+)
 
-type LocalHeavyHitter struct {
-	Key   string
+// GenericLocalHeavyHitter is a key reported by a GenericSketch along with its
+// estimated count and the bounds of its true count.
+//
+// Count is the count-min estimate, which is an upper bound of the true count.
+// Lower is a lower bound, the largest heavy hitter counter of the rows in
+// which the key is the candidate, of which there are Votes. Keys with few votes
+// or a large gap between the bounds are uncertain.
+type GenericLocalHeavyHitter[K comparable] struct {
+	Key   K
 	Count uint64
+	Lower uint64
+	Votes int
+}
+
+// LocalHeavyHitter is a key reported by a Sketch along with its estimated count.
+type LocalHeavyHitter = GenericLocalHeavyHitter[string]
+
+// GenericSketch is a Topkapi sketch over keys of any comparable type, which
+// are hashed by a pluggable Hasher.
+type GenericSketch[K comparable] struct {
+	l uint64 // number of rows
+	b uint64 // think of this as the k
+	k uint64 // number of heavy hitters the sketch was sized for, if known
+
+	total uint64 // total count inserted
+
+	// conservative makes inserts raise the count-min counters only as far as
+	// needed, see WithConservativeUpdate
+	conservative bool
+
+	// Buckets with 64, 32 or 16 bit counters, only one of which is set
+	buckets   []bucket
+	buckets32 []bucket32
+	buckets16 []bucket16
+
+	keys   interner[K]
+	hasher Hasher[K]
+}
+
+// fingerprint returns the tag of a key with hash sum hsum.
+func fingerprint(hsum uint64) uint32 {
+	return uint32(hsum>>32) ^ uint32(hsum)
+}
+
+// holds returns whether the candidate of ref is key, whose tag is tag. The tag
+// of buckets holding the zero key is meaningless.
+func (sk *GenericSketch[K]) holds(ref *keyRef, key K, tag uint32) bool {
+	if ref.key == 0 {
+		var zero K
+		return key == zero
+	}
+	return ref.tag == tag && sk.keys.key(ref.key) == key
+}
+
+// find returns the index of key, whose hash sum is hsum, if a bucket holds
+// it, and 0 otherwise. Keys are only held by the buckets they hash to, so
+// those are the only ones to look at.
+func (sk *GenericSketch[K]) find(key K, hsum uint64) uint32 {
+	switch {
+	case sk.buckets16 != nil:
+		return find(sk, sk.buckets16, key, hsum, 0)
+	case sk.buckets32 != nil:
+		return find(sk, sk.buckets32, key, hsum, 0)
+	}
+	return find(sk, sk.buckets, key, hsum, 0)
+}
+
+// find is like GenericSketch.find, looking at the rows of buckets from row
+// from on.
+func find[K comparable, C unsignedCounter, S signedCounter](sk *GenericSketch[K], buckets []bucketOf[C, S], key K, hsum, from uint64) uint32 {
+	h1, h2 := hashes(hsum)
+	tag := fingerprint(hsum)
+
+	for i := from; i < sk.l; i++ {
+		h := uint64((h1 + uint32(i)*h2))
+		if bk := &buckets[i*sk.b+h%sk.b]; bk.key != 0 && sk.holds(&bk.keyRef, key, tag) {
+			return bk.key
+		}
+	}
+	return 0
+}
+
+// assign makes key, whose hash sum is hsum, the candidate of ref. idx is the
+// index of key if a bucket holds it already, or 0 if it is to be added. The
+// index of key is returned.
+func (sk *GenericSketch[K]) assign(ref *keyRef, key K, hsum uint64, idx uint32) uint32 {
+	if idx != 0 {
+		sk.keys.ref(idx)
+	} else {
+		idx = sk.keys.acquire(key, hsum)
+	}
+	sk.keys.release(ref.key)
+	ref.key, ref.tag = idx, fingerprint(hsum)
+	return idx
 }
 
+// Sketch is the GenericSketch over string keys, hashed with metro hash unless
+// configured otherwise with WithHash.
+// In addition to the generic methods it can take keys as byte slices.
 type Sketch struct {
-	l      uint64 // number of rows
-	b      uint64 // think of this as the k
-	cms    [][]uint64
-	counts [][]int64
-	words  [][]string
+	GenericSketch[string]
 }
 
 // New creates a new Topkapi Sketch with given error rate and confidence.
 // Accuracy guarantees will be made in terms of a pair of user specified parameters,
 // ε and δ, meaning that the error in answering a query is within a factor of ε with
 // probability 1-δ
-func New(delta, epsilon float64) (*Sketch, error) {
-	if epsilon <= 0 || epsilon >= 1 {
-		return nil, errors.New("topkapi: value of epsilon should be in range of (0, 1)")
-	}
-	if delta <= 0 || delta >= 1 {
-		return nil, errors.New("topkapi: value of delta should be in range of (0, 1)")
-	}
+func New(delta, epsilon float64, opts ...Option) (*Sketch, error) {
+	return NewWithOptions(append([]Option{WithEpsilon(epsilon), WithDelta(delta)}, opts...)...)
+}
 
-	var (
-		b = uint64(math.Ceil(1 / epsilon))
-		l = uint64(math.Log(2 / delta))
-	)
+// NewGeneric is like New, but creates a sketch over keys of type K which are
+// hashed with hasher.
+func NewGeneric[K comparable](delta, epsilon float64, hasher Hasher[K]) (*GenericSketch[K], error) {
+	return NewGenericWithOptions(hasher, WithEpsilon(epsilon), WithDelta(delta))
+}
 
-	//fmt.Printf("b=%d, l=%d, epsilon=%f, delta=%f\n", b, l, epsilon, delta)
+// NewTopK creates a sketch suitable for finding TopK in a corpus of a given size.
+// For compatibility with existing sketches, delta is not used and the sketch
+// always has 4 rows; use NewWithOptions with WithDelta to size the rows.
+func NewTopK(k, approxCorpusSize uint64, delta float64, opts ...Option) (*Sketch, error) {
+	return NewWithOptions(append([]Option{WithK(k), WithCorpusSize(approxCorpusSize)}, opts...)...)
+}
 
-	return newSketch(b, l), nil
+// NewGenericTopK is like NewTopK, but creates a sketch over keys of type K
+// which are hashed with hasher.
+func NewGenericTopK[K comparable](k, approxCorpusSize uint64, delta float64, hasher Hasher[K]) (*GenericSketch[K], error) {
+	return NewGenericWithOptions(hasher, WithK(k), WithCorpusSize(approxCorpusSize))
 }
 
-// NewTopK creates a sketch suitable for finding TopK in a corpus of a given size,
-// with an error rate of delta.
-func NewTopK(k, approxCorpusSize uint64, delta float64) (*Sketch, error) {
-	if k < 1 {
-		return nil, errors.New("topkapi: value of k should be in >= 1")
+func newSketch(b, l uint64) *Sketch {
+	return &Sketch{*newGenericSketch[string](b, l, 64, MetroHasher{Seed: DefaultSeed})}
+}
+
+func newGenericSketch[K comparable](b, l uint64, width int, hasher Hasher[K]) *GenericSketch[K] {
+	sk := &GenericSketch[K]{
+		l:      l,
+		b:      b,
+		keys:   newInterner[K](),
+		hasher: hasher,
 	}
+	sk.makeBuckets(width)
+	return sk
+}
 
-	// We want to grow ~ k*log(corpus size)
-	// The factor 55 was chosen through experiementation as the minimal threshold where
-	// the error rates don't grow out of control on merge and our tests pass.
-	// Example: for top-20 on a corpus of 1M we require 15197 buckets and ~475kb space.
-	numBuckets := uint64(55.0 * float64(k) * math.Log(float64(approxCorpusSize)))
-	numHashFuncs := uint64(4)
+// newLike creates an empty sketch with the same configuration as sk.
+func (sk *GenericSketch[K]) newLike() *GenericSketch[K] {
+	tmp := newGenericSketch(sk.b, sk.l, sk.CounterWidth(), sk.hasher)
+	tmp.k = sk.k
+	tmp.conservative = sk.conservative
+	return tmp
+}
 
-	return newSketch(numBuckets, numHashFuncs), nil
+// newSketchLike creates an empty sketch with the same configuration as sk.
+func newSketchLike(sk *Sketch) *Sketch {
+	return &Sketch{*sk.newLike()}
 }
 
-func newSketch(b, l uint64) *Sketch {
-	var (
-		cms    = make([][]uint64, l)
-		counts = make([][]int64, l)
-		words  = make([][]string, l)
-	)
+// Hasher returns the hasher of the sketch.
+func (sk *GenericSketch[K]) Hasher() Hasher[K] {
+	return sk.hasher
+}
 
-	for i := range counts {
-		cms[i] = make([]uint64, b)
-		counts[i] = make([]int64, b)
-		words[i] = make([]string, b)
-	}
+// Conservative returns whether the sketch uses conservative updates, see
+// WithConservativeUpdate.
+func (sk *GenericSketch[K]) Conservative() bool {
+	return sk.conservative
+}
 
-	return &Sketch{
-		l:      l,
-		b:      b,
-		counts: counts,
-		words:  words,
-		cms:    cms,
-	}
+// Dimensions returns the number of rows and the number of buckets per row.
+func (sk *GenericSketch[K]) Dimensions() (rows, buckets uint64) {
+	return sk.l, sk.b
+}
+
+// MemoryUsage returns the approximate number of bytes used by the sketch,
+// including the data of the string keys retained in its buckets. Keys are
+// stored once no matter how many buckets hold them.
+func (sk *GenericSketch[K]) MemoryUsage() uint64 {
+	size := uint64(unsafe.Sizeof(*sk))
+	size += sk.l * sk.b * bucketBytes(sk.CounterWidth())
+	size += sk.keys.memoryUsage()
+	return size
 }
 
 // Epsilon is the approximate error range factor.
-func (sk *Sketch) Epsilon() float64 {
+func (sk *GenericSketch[K]) Epsilon() float64 {
 	return 1.0 / float64(sk.b)
 }
 
 // Delta is the probability for a measurement to be outside the epsilon range
-func (sk *Sketch) Delta() float64 {
+func (sk *GenericSketch[K]) Delta() float64 {
 	return 2.0 / math.Exp(float64(sk.l))
 }
 
+func hashes(hsum uint64) (h1, h2 uint32) {
+	return uint32(hsum & 0xffffffff), uint32((hsum >> 32) & 0xffffffff)
+}
+
+// takeover returns the heavy hitter counter of a key taking over a bucket,
+// given the bucket's counter after subtracting the count being inserted. This
+// makes inserting a key with a count equivalent to inserting it count times.
+func takeover(rest int64, count uint64) int64 {
+	if rest+int64(count) <= 0 {
+		return int64(count)
+	}
+	return 1 - rest
+}
+
 // Insert ...
-func (sk *Sketch) Insert(key string, count uint64) {
+func (sk *GenericSketch[K]) Insert(key K, count uint64) {
+	sk.insertHashed(key, sk.hasher.Hash(key), count)
+}
+
+// insertHashed inserts count occurrences of key, whose hash sum is hsum.
+func (sk *GenericSketch[K]) insertHashed(key K, hsum, count uint64) {
+	target := sk.target(hsum, count)
+	sk.total += count
+
+	for i := uint64(0); ; sk.widen() {
+		switch {
+		case sk.buckets16 != nil:
+			i = insert(sk, sk.buckets16, key, hsum, count, target, i)
+		case sk.buckets32 != nil:
+			i = insert(sk, sk.buckets32, key, hsum, count, target, i)
+		default:
+			insert(sk, sk.buckets, key, hsum, count, target, i)
+			return
+		}
+		if i == sk.l {
+			return
+		}
+	}
+}
+
+// target returns the value conservative updates raise the count-min counters
+// of a key with hash sum hsum to when inserting count, which is its estimate
+// after the insert. It returns 0 for sketches without conservative updates.
+func (sk *GenericSketch[K]) target(hsum, count uint64) uint64 {
+	if !sk.conservative {
+		return 0
+	}
+
+	h1, h2 := hashes(hsum)
+	min := uint64(math.MaxUint64)
+	for i := uint64(0); i < sk.l; i++ {
+		h := uint64((h1 + uint32(i)*h2))
+		if c := sk.bucketAt(i*sk.b + h%sk.b).cms; c < min {
+			min = c
+		}
+	}
+	return min + count
+}
+
+// update adds count to the count-min counter of bk, or raises it to target
+// for sketches with conservative updates.
+func update[K comparable, C unsignedCounter, S signedCounter](sk *GenericSketch[K], bk *bucketOf[C, S], count, target uint64) {
+	if !sk.conservative {
+		bk.cms += C(count)
+	} else if uint64(bk.cms) < target {
+		bk.cms = C(target)
+	}
+}
+
+// insert inserts key with hash sum hsum into buckets, starting at row from.
+// It returns the row at which it stopped because a counter would overflow,
+// or the number of rows if it inserted into all of them.
+func insert[K comparable, C unsignedCounter, S signedCounter](sk *GenericSketch[K], buckets []bucketOf[C, S], key K, hsum, count, target, from uint64) uint64 {
 	var (
-		hsum = metro.Hash64Str(key, 1337)
-		h1   = uint32(hsum & 0xffffffff)
-		h2   = uint32((hsum >> 32) & 0xffffffff)
+		h1, h2 = hashes(hsum)
+		tag    = fingerprint(hsum)
+		idx    uint32 // index of key, once known
 	)
+	// Rows before from were inserted into before the counters were widened,
+	// and may have made key their candidate
+	if from > 0 {
+		idx = find(sk, buckets, key, hsum, 0)
+	}
 
-	for i := range sk.counts {
+	for i := from; i < sk.l; i++ {
 		h := uint64((h1 + uint32(i)*h2))
-		hi := h % sk.b
+		bk := &buckets[i*sk.b+h%sk.b]
 
-		sk.cms[i][hi] += count
+		if !bk.canAdd(count) {
+			return i
+		}
 
-		if sk.words[i][hi] == key {
-			sk.counts[i][hi] += int64(count)
+		update(sk, bk, count, target)
+
+		if sk.holds(&bk.keyRef, key, tag) {
+			bk.count += S(count)
+			idx = bk.key
 		} else {
-			sk.counts[i][hi] -= int64(count)
-			if sk.counts[i][hi] <= 0 {
-				sk.words[i][hi] = key
-				sk.counts[i][hi] = 1
+			bk.count -= S(count)
+			if bk.count <= 0 {
+				// rows before i would have given the index of key
+				if idx == 0 {
+					idx = find(sk, buckets, key, hsum, i+1)
+				}
+				idx = sk.assign(&bk.keyRef, key, hsum, idx)
+				bk.count = S(takeover(int64(bk.count), count))
 			}
 		}
 	}
+	return sk.l
+}
+
+// batchSize is the number of keys hashed up front by InsertBatch before they
+// are inserted.
+const batchSize = 256
+
+// InsertBatch inserts each of keys with the count at the same index in counts,
+// which must have the same length as keys. The result is the same as calling
+// Insert for each key, and about as fast: keys are hashed a batch at a time,
+// then inserted one by one. Inserting a batch one row at a time, in bucket
+// order or not, measured slower, as the rows of large sketches don't fit in
+// cache either way.
+func (sk *GenericSketch[K]) InsertBatch(keys []K, counts []uint64) {
+	if len(keys) != len(counts) {
+		panic("topkapi: InsertBatch called with different number of keys and counts")
+	}
+	sk.insertBatch(keys, counts)
 }
 
-// Result ...
-func (sk *Sketch) Result(threshold uint64) []LocalHeavyHitter {
+// InsertMany is like InsertBatch with a count of 1 for each key.
+func (sk *GenericSketch[K]) InsertMany(keys []K) {
+	sk.insertBatch(keys, nil)
+}
+
+// insertBatch inserts keys with their counts, or a count of 1 if counts is nil.
+func (sk *GenericSketch[K]) insertBatch(keys []K, counts []uint64) {
+	var hs [batchSize]uint64
+
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > batchSize {
+			n = batchSize
+		}
+
+		for j, key := range keys[:n] {
+			hs[j] = sk.hasher.Hash(key)
+		}
+		for j, key := range keys[:n] {
+			count := uint64(1)
+			if counts != nil {
+				count = counts[j]
+			}
+			sk.insertHashed(key, hs[j], count)
+		}
+
+		keys = keys[n:]
+		if counts != nil {
+			counts = counts[n:]
+		}
+	}
+}
+
+// InsertBytes is like Insert, but takes the key as a byte slice. The key is
+// only copied when it takes over a bucket and is not a candidate of another
+// bucket yet, so inserting keys that are already tracked, or that lose against
+// the current candidates, does not allocate.
+func (sk *Sketch) InsertBytes(key []byte, count uint64) {
+	hsum := sk.hashBytes(key)
+	target := sk.target(hsum, count)
+	sk.total += count
+
+	for i := uint64(0); ; sk.widen() {
+		switch {
+		case sk.buckets16 != nil:
+			i = insertBytes(sk, sk.buckets16, key, hsum, count, target, i)
+		case sk.buckets32 != nil:
+			i = insertBytes(sk, sk.buckets32, key, hsum, count, target, i)
+		default:
+			insertBytes(sk, sk.buckets, key, hsum, count, target, i)
+			return
+		}
+		if i == sk.l {
+			return
+		}
+	}
+}
+
+// holdsBytes is like holds for byte slice keys.
+func (sk *Sketch) holdsBytes(ref *keyRef, key []byte, tag uint32) bool {
+	if ref.key == 0 {
+		return len(key) == 0
+	}
+	return ref.tag == tag && sk.keys.key(ref.key) == string(key)
+}
+
+// findBytes is like find for byte slice keys.
+func findBytes[C unsignedCounter, S signedCounter](sk *Sketch, buckets []bucketOf[C, S], key []byte, hsum, from uint64) uint32 {
+	h1, h2 := hashes(hsum)
+	tag := fingerprint(hsum)
+
+	for i := from; i < sk.l; i++ {
+		h := uint64((h1 + uint32(i)*h2))
+		if bk := &buckets[i*sk.b+h%sk.b]; bk.key != 0 && sk.holdsBytes(&bk.keyRef, key, tag) {
+			return bk.key
+		}
+	}
+	return 0
+}
+
+// insertBytes is like insert for byte slice keys.
+func insertBytes[C unsignedCounter, S signedCounter](sk *Sketch, buckets []bucketOf[C, S], key []byte, hsum, count, target, from uint64) uint64 {
 	var (
-		seen = make(map[string]int)
-		cs   = make([]LocalHeavyHitter, 0, sk.b)
+		h1, h2 = hashes(hsum)
+		tag    = fingerprint(hsum)
+		idx    uint32 // index of key, once known
 	)
+	if from > 0 {
+		idx = findBytes(sk, buckets, key, hsum, 0)
+	}
 
-	for i := range sk.words {
-		for j, word := range sk.words[i] {
-			count := sk.cms[i][j]
-			if count < threshold {
-				continue
-			}
-			idx, ok := seen[word]
-			if !ok {
-				idx = len(cs)
-				seen[word] = idx
-				cs = append(cs, LocalHeavyHitter{
-					Key:   word,
-					Count: count,
-				})
+	for i := from; i < sk.l; i++ {
+		h := uint64((h1 + uint32(i)*h2))
+		bk := &buckets[i*sk.b+h%sk.b]
+
+		if !bk.canAdd(count) {
+			return i
+		}
+
+		update(&sk.GenericSketch, bk, count, target)
+
+		if sk.holdsBytes(&bk.keyRef, key, tag) {
+			bk.count += S(count)
+			idx = bk.key
+		} else {
+			bk.count -= S(count)
+			if bk.count <= 0 {
+				if idx == 0 {
+					idx = findBytes(sk, buckets, key, hsum, i+1)
+				}
+				if idx != 0 {
+					sk.keys.ref(idx)
+				} else {
+					idx = acquireBytes(&sk.keys, key, hsum)
+				}
+				sk.keys.release(bk.key)
+				bk.key, bk.tag = idx, tag
+				bk.count = S(takeover(int64(bk.count), count))
 			}
-			if count < cs[idx].Count {
-				cs[idx].Count = count
+		}
+	}
+	return sk.l
+}
+
+// Remove retracts count occurrences of key that were inserted before, as in
+// the turnstile model. The count-min rows are decremented, and if key is the
+// heavy hitter candidate of a row its counter is decremented as well, giving up
+// the bucket once it reaches zero. The counters of other candidates are left
+// alone, as they may never have been reduced by key.
+//
+// As long as no more occurrences of any key are removed than were inserted,
+// counts are still upper bounds of the true counts, and Lower still a lower
+// bound. The error of the counts is however bounded by Epsilon times the total
+// count inserted, which may be far more than Total after removals. Keys may also
+// fail to be reported until they win back the rows whose candidates were
+// removed. Removing more occurrences than were inserted voids all guarantees,
+// and the count-min counters stop at zero instead of going negative.
+//
+// Remove is not supported by sketches with conservative updates, which could
+// underestimate counts afterwards.
+func (sk *GenericSketch[K]) Remove(key K, count uint64) error {
+	if sk.conservative {
+		return errRemoveUnsupported
+	}
+
+	hsum := sk.hasher.Hash(key)
+	if count > sk.total {
+		sk.total = 0
+	} else {
+		sk.total -= count
+	}
+
+	switch {
+	case sk.buckets16 != nil:
+		remove(sk, sk.buckets16, key, hsum, count)
+	case sk.buckets32 != nil:
+		remove(sk, sk.buckets32, key, hsum, count)
+	default:
+		remove(sk, sk.buckets, key, hsum, count)
+	}
+	return nil
+}
+
+// remove removes count occurrences of key with hash sum hsum from buckets.
+// Counters only decrease, so they can't overflow.
+func remove[K comparable, C unsignedCounter, S signedCounter](sk *GenericSketch[K], buckets []bucketOf[C, S], key K, hsum, count uint64) {
+	h1, h2 := hashes(hsum)
+	tag := fingerprint(hsum)
+
+	for i := uint64(0); i < sk.l; i++ {
+		h := uint64((h1 + uint32(i)*h2))
+		bk := &buckets[i*sk.b+h%sk.b]
+
+		if uint64(bk.cms) < count {
+			bk.cms = 0
+		} else {
+			bk.cms -= C(count)
+		}
+
+		if bk.count <= 0 || !sk.holds(&bk.keyRef, key, tag) {
+			continue
+		}
+		if uint64(bk.count) > count {
+			bk.count -= S(count)
+		} else {
+			sk.keys.release(bk.key)
+			bk.keyRef = keyRef{}
+			bk.count = 0
+		}
+	}
+}
+
+// Reset empties the sketch in place, keeping its configuration and the memory
+// allocated for its buckets and keys. Counters that were promoted to a wider
+// width keep it.
+func (sk *GenericSketch[K]) Reset() {
+	for i := range sk.buckets {
+		sk.buckets[i] = bucket{}
+	}
+	for i := range sk.buckets32 {
+		sk.buckets32[i] = bucket32{}
+	}
+	for i := range sk.buckets16 {
+		sk.buckets16[i] = bucket16{}
+	}
+	sk.total = 0
+	sk.keys.reset()
+}
+
+// Estimate returns the count-min estimate for key, which is an upper bound of
+// its true frequency, and whether key is currently a heavy hitter candidate
+// in any of the rows.
+func (sk *GenericSketch[K]) Estimate(key K) (uint64, bool) {
+	count, _, votes := sk.estimate(sk.hasher.Hash(key), func(w K) bool { return w == key })
+	return count, votes > 0
+}
+
+// EstimateBytes is like Estimate, but takes the key as a byte slice.
+func (sk *Sketch) EstimateBytes(key []byte) (uint64, bool) {
+	count, _, votes := sk.estimate(sk.hashBytes(key), func(w string) bool { return w == string(key) })
+	return count, votes > 0
+}
+
+// hashBytes hashes key like the sketch's hasher would hash it as a string.
+func (sk *Sketch) hashBytes(key []byte) uint64 {
+	if h, ok := sk.hasher.(BytesHasher); ok {
+		return h.HashBytes(key)
+	}
+	return sk.hasher.Hash(string(key))
+}
+
+// estimate returns the count-min estimate for the key with hash sum hsum, the
+// largest heavy hitter counter of the rows in which a key matching match is the
+// candidate, and the number of those rows.
+func (sk *GenericSketch[K]) estimate(hsum uint64, match func(K) bool) (count, lower uint64, votes int) {
+	var (
+		h1, h2 = hashes(hsum)
+		min    = uint64(math.MaxUint64)
+	)
+
+	for i := uint64(0); i < sk.l; i++ {
+		h := uint64((h1 + uint32(i)*h2))
+		bk := sk.bucketAt(i*sk.b + h%sk.b)
+
+		if bk.cms < min {
+			min = bk.cms
+		}
+		if bk.count > 0 && match(sk.keys.key(bk.key)) {
+			votes++
+			if uint64(bk.count) > lower {
+				lower = uint64(bk.count)
 			}
 		}
 	}
 
+	if sk.l == 0 {
+		return 0, 0, 0
+	}
+	return min, lower, votes
+}
+
+// heavyHitter returns key with its estimate and bounds, as reported by Result.
+func (sk *GenericSketch[K]) heavyHitter(key K) GenericLocalHeavyHitter[K] {
+	count, lower, votes := sk.estimate(sk.hasher.Hash(key), func(w K) bool { return w == key })
+	return GenericLocalHeavyHitter[K]{Key: key, Count: count, Lower: lower, Votes: votes}
+}
+
+// Total returns the total count inserted into the sketch and the sketches
+// merged into it.
+func (sk *GenericSketch[K]) Total() uint64 {
+	return sk.total
+}
+
+// ResultFraction returns the keys whose count is estimated to be at least phi
+// times the total count, like Result with the corresponding threshold. phi is
+// clamped to the range [0, 1], with NaN counting as 0.
+func (sk *GenericSketch[K]) ResultFraction(phi float64) []GenericLocalHeavyHitter[K] {
+	switch {
+	case !(phi >= 0):
+		phi = 0
+	case phi > 1:
+		phi = 1
+	}
+	return sk.Result(uint64(math.Ceil(phi * float64(sk.total))))
+}
+
+// Result returns all heavy hitter candidates whose count-min estimate is at
+// least threshold and which are the candidate of a majority of the rows,
+// ordered by descending count, along with the bounds of their true counts.
+func (sk *GenericSketch[K]) Result(threshold uint64) []GenericLocalHeavyHitter[K] {
+	return sk.ResultWithVotes(threshold, sk.majority())
+}
+
+// majority returns the number of rows that make up a majority.
+func (sk *GenericSketch[K]) majority() int {
+	return int(sk.l/2 + 1)
+}
+
+// ResultWithVotes is like Result, but reports candidates of at least minVotes
+// rows. Keys that are the candidate of few rows are more likely to be false
+// positives, which merely collide with heavy hitters in the rows they hold.
+// A minVotes of 1 reports every candidate.
+func (sk *GenericSketch[K]) ResultWithVotes(threshold uint64, minVotes int) []GenericLocalHeavyHitter[K] {
+	var (
+		seen = make(map[uint32]struct{})
+		cs   = make([]GenericLocalHeavyHitter[K], 0, sk.b)
+	)
+
+	for i := uint64(0); i < sk.l*sk.b; i++ {
+		bk := sk.bucketAt(i)
+		// The estimate is never above the bucket count, so this bucket can be skipped
+		if bk.cms < threshold || bk.count <= 0 {
+			continue
+		}
+		if _, ok := seen[bk.key]; ok {
+			continue
+		}
+		seen[bk.key] = struct{}{}
+		if hh := sk.heavyHitter(sk.keys.key(bk.key)); hh.Count >= threshold && hh.Votes >= minVotes {
+			cs = append(cs, hh)
+		}
+	}
+
 	sort.Slice(cs, func(a, b int) bool {
 		return cs[a].Count > cs[b].Count
 	})
@@ -156,60 +672,447 @@ func (sk *Sketch) Result(threshold uint64) []LocalHeavyHitter {
 	return cs
 }
 
-// Merge ...
-func (sk *Sketch) Merge(other *Sketch) error {
-	if sk.b != other.b || sk.l != other.l {
-		return incompatibleSketches
+// TopK returns the k heaviest keys in the sketch, ordered by descending count.
+// The counts are the same as those reported by Result, but keys are not
+// filtered by their votes.
+func (sk *GenericSketch[K]) TopK(k int) []GenericLocalHeavyHitter[K] {
+	if k <= 0 {
+		return nil
 	}
 
-	// HALP: This is probably wrong - the article doesn't explain how to merge!
-	for i := range sk.counts {
-		ws := sk.words[i]
-		ows := other.words[i]
-		cnt := sk.counts[i]
-		ocnt := other.counts[i]
-		cms := sk.cms[i]
-		ocms := other.cms[i]
-		for j := range cnt {
-			if ws[j] == ows[j] {
-				cnt[j] += ocnt[j]
-				cms[j] += ocms[j]
-			} else if cnt[j] < ocnt[j] {
-				ws[j] = ows[j]
-				cnt[j] = ocnt[j]
-				cms[j] = ocms[j]
-			}
+	var (
+		seen = make(map[uint32]struct{})
+		h    = make(minHeap[K], 0, k)
+	)
 
+	for i := uint64(0); i < sk.l*sk.b; i++ {
+		bk := sk.bucketAt(i)
+		// Buckets whose candidate was removed hold no key
+		if bk.count <= 0 {
+			continue
 		}
+		if _, ok := seen[bk.key]; ok {
+			continue
+		}
+		seen[bk.key] = struct{}{}
+
+		hh := sk.heavyHitter(sk.keys.key(bk.key))
+		if len(h) < k {
+			heap.Push(&h, hh)
+		} else if hh.Count > h[0].Count {
+			h[0] = hh
+			heap.Fix(&h, 0)
+		}
+	}
+
+	cs := make([]GenericLocalHeavyHitter[K], len(h))
+	for i := len(cs) - 1; i >= 0; i-- {
+		cs[i] = heap.Pop(&h).(GenericLocalHeavyHitter[K])
 	}
+	return cs
+}
 
+// Top returns the top k keys for the k the sketch was created with by NewTopK.
+// Sketches created with New have no such k, and Top returns nil for them.
+func (sk *GenericSketch[K]) Top() []GenericLocalHeavyHitter[K] {
+	return sk.TopK(int(sk.k))
+}
+
+// Merge folds other into sk, so that sk summarizes the union of both streams.
+//
+// The count-min rows are additive, so the merged counts are identical to those
+// of a single sketch that saw both streams. Each bucket's heavy hitter
+// counter is merged like a single Misra-Gries counter: if both buckets track
+// the same key their counters are added, otherwise the key with the larger
+// counter survives and its counter is reduced by the smaller one. This keeps
+// the invariant that any key occurring in more than half of a bucket's total
+// count is the bucket's candidate, which is what Result relies on. As with a
+// single sketch, the counts reported for merged sketches never underestimate
+// and exceed the true count by more than Epsilon times the total merged count
+// with probability at most Delta.
+//
+// Merging sketches with conservative updates adds their count-min rows all the
+// same, which keeps the counts upper bounds but loosens them to those of
+// standard sketches. Sketches with conservative updates cannot be merged with
+// standard ones, whose counts would be mixed up with tighter ones.
+//
+// Sketches can only be merged if they have the same dimensions, hash keys the
+// same way and either both or neither use conservative updates.
+func (sk *GenericSketch[K]) Merge(other *GenericSketch[K]) error {
+	if !sk.compatible(other) {
+		return incompatibleSketches
+	}
+	sk.total += other.total
+
+	m := &keyMap{idxs: make([]uint32, len(other.keys.entries))}
+	for i := uint64(0); ; sk.widen() {
+		switch {
+		case sk.buckets16 != nil:
+			i = merge(sk, sk.buckets16, other, m, i)
+		case sk.buckets32 != nil:
+			i = merge(sk, sk.buckets32, other, m, i)
+		default:
+			i = merge(sk, sk.buckets, other, m, i)
+		}
+		if i == sk.l*sk.b {
+			break
+		}
+	}
+
+	for _, idx := range m.released {
+		sk.keys.release(idx)
+	}
 	return nil
 }
 
-// Marshal ...
-func (sk *Sketch) Marshal() ([]byte, error) {
+// keyMap maps the indices of the keys of a sketch being merged to those of the
+// same keys in the sketch it is merged into, so that the keys of buckets only
+// need to be compared for the first row holding them. Keys released during
+// the merge are only dropped once it is done, so that their indices can't be
+// reused for other keys in the meantime.
+type keyMap struct {
+	idxs     []uint32
+	released []uint32
+}
+
+// compatible returns whether the buckets of sk and other count the same keys
+// the same way, so that they can be combined bucket by bucket.
+func (sk *GenericSketch[K]) compatible(other *GenericSketch[K]) bool {
+	return sk.b == other.b && sk.l == other.l && sameHasher(sk.hasher, other.hasher) && sk.conservative == other.conservative
+}
+
+// merge merges the buckets of other into buckets, starting at bucket from. It
+// returns the bucket at which it stopped because a counter would overflow, or
+// the number of buckets if it merged all of them.
+func merge[K comparable, C unsignedCounter, S signedCounter](sk *GenericSketch[K], buckets []bucketOf[C, S], other *GenericSketch[K], m *keyMap, from uint64) uint64 {
+	for i := from; i < uint64(len(buckets)); i++ {
+		var (
+			bk, obk = &buckets[i], other.bucketAt(i)
+			cms     = uint64(bk.cms) + obk.cms
+			count   = int64(bk.count)
+			take    bool
+		)
+
+		switch {
+		case obk.count <= 0:
+			// other bucket tracks nothing
+		case count <= 0:
+			count, take = obk.count, true
+		case sk.sameKey(&bk.keyRef, other, obk.keyRef, m):
+			count += obk.count
+		case count < obk.count:
+			count, take = obk.count-count, true
+		default:
+			count -= obk.count
+		}
+
+		if !bk.canStore(cms, count) {
+			return i
+		}
+
+		bk.cms, bk.count = C(cms), S(count)
+		if take {
+			idx := m.idxs[obk.key]
+			switch {
+			case idx != 0:
+				sk.keys.ref(idx)
+			case obk.key != 0:
+				okey, h := other.keys.key(obk.key), other.keys.hash(obk.key)
+				if idx = sk.find(okey, h); idx != 0 {
+					sk.keys.ref(idx)
+				} else {
+					idx = sk.keys.share(okey, h)
+				}
+				m.idxs[obk.key] = idx
+			}
+			if bk.key != 0 {
+				m.released = append(m.released, bk.key)
+			}
+			bk.key, bk.tag = idx, obk.tag
+		}
+	}
+	return uint64(len(buckets))
+}
+
+// sameKey returns whether ref holds the same key as oref of other, recording
+// it in m if so.
+func (sk *GenericSketch[K]) sameKey(ref *keyRef, other *GenericSketch[K], oref keyRef, m *keyMap) bool {
+	switch {
+	case ref.key == 0 || oref.key == 0:
+		return ref.key == oref.key
+	case m.idxs[oref.key] == ref.key:
+		return true
+	case ref.tag == oref.tag && sk.keys.key(ref.key) == other.keys.key(oref.key):
+		m.idxs[oref.key] = ref.key
+		return true
+	}
+	return false
+}
+
+// Merge is like GenericSketch.Merge.
+func (sk *Sketch) Merge(other *Sketch) error {
+	return sk.GenericSketch.Merge(&other.GenericSketch)
+}
+
+// Marshal serializes a sketch over string keys. Sketches over other keys must
+// be serialized with MarshalWith.
+func (sk *GenericSketch[K]) Marshal() ([]byte, error) {
+	return sk.MarshalWith(nil)
+}
+
+// MarshalWith serializes the sketch, encoding keys with codec. The codec may
+// be nil for sketches over string keys.
+func (sk *GenericSketch[K]) MarshalWith(codec KeyCodec[K]) ([]byte, error) {
+	strs, isString := any(sk.keys.entries).([]entry[string])
+	if !isString && codec == nil {
+		return nil, errNoCodec
+	}
+
+	var (
+		cms    = make([][]uint64, sk.l)
+		counts = make([][]int64, sk.l)
+		idxs   = make([][]uint32, sk.l)
+		keys   = make([]string, 1, sk.keys.len()+1)
+		remap  = make(map[uint32]uint32, sk.keys.len())
+	)
+
+	for i := range cms {
+		cms[i] = make([]uint64, sk.b)
+		counts[i] = make([]int64, sk.b)
+		idxs[i] = make([]uint32, sk.b)
+		for j := range cms[i] {
+			bk := sk.bucketAt(uint64(i)*sk.b + uint64(j))
+			cms[i][j] = bk.cms
+			counts[i][j] = bk.count
+			if bk.key == 0 {
+				continue
+			}
+
+			// Keys are renumbered in order of appearance, leaving out free slots
+			idx, ok := remap[bk.key]
+			if !ok {
+				idx = uint32(len(keys))
+				remap[bk.key] = idx
+				if codec == nil {
+					keys = append(keys, strs[bk.key].key)
+				} else {
+					p, err := codec.EncodeKey(sk.keys.key(bk.key))
+					if err != nil {
+						return nil, err
+					}
+					keys = append(keys, string(p))
+				}
+			}
+			idxs[i][j] = idx
+		}
+	}
+	if codec != nil {
+		var zero K
+		p, err := codec.EncodeKey(zero)
+		if err != nil {
+			return nil, err
+		}
+		keys[0] = string(p)
+	}
+
 	tmp := &msgp.Sketch{
 		L:      sk.l,
 		B:      sk.b,
-		CMS:    sk.cms,
-		Counts: sk.counts,
-		Words:  sk.words,
+		K:      sk.k,
+		CMS:    cms,
+		Counts: counts,
+		Keys:   keys,
+		KeyIdx: idxs,
+		Width:  uint8(sk.CounterWidth()),
+
+		Total:        &sk.total,
+		Conservative: sk.conservative,
+	}
+	if h, ok := sk.hasher.(IdentifiedHasher); ok {
+		fn, seed := h.HashID()
+		tmp.Hash, tmp.Seed = string(fn), seed
+	} else {
+		tmp.Hash = customHash
 	}
 	return tmp.MarshalMsg(nil)
 }
 
-// Unmarshal ...
-func (sk *Sketch) Unmarshal(p []byte) error {
+// Unmarshal deserializes a sketch over string keys. Sketches over other keys
+// must be deserialized with UnmarshalWith.
+func (sk *GenericSketch[K]) Unmarshal(p []byte) error {
+	return sk.UnmarshalWith(p, nil)
+}
+
+// UnmarshalWith deserializes a sketch, decoding keys with codec. The codec may
+// be nil for sketches over string keys.
+//
+// Sketches over string keys get the hasher they were marshalled with. Other
+// sketches keep the hasher of sk, which must match the one they were
+// marshalled with.
+func (sk *GenericSketch[K]) UnmarshalWith(p []byte, codec KeyCodec[K]) error {
 	tmp := &msgp.Sketch{}
 	if _, err := tmp.UnmarshalMsg(p); err != nil {
 		return err
 	}
-	*sk = Sketch{
-		l:      tmp.L,
-		b:      tmp.B,
-		cms:    tmp.CMS,
-		counts: tmp.Counts,
-		words:  tmp.Words,
+
+	hasher, err := unmarshalHasher(sk.hasher, HashFunc(tmp.Hash), tmp.Seed)
+	if err != nil {
+		return err
+	}
+
+	width := int(tmp.Width)
+	if width == 0 {
+		// Sketches marshalled before counter widths were configurable
+		width = 64
+	}
+	if !validWidth(width) {
+		return errMalformed
+	}
+
+	if tmp.Keys == nil {
+		// Sketches marshalled before keys were deduplicated store them per bucket
+		tmp.Keys, tmp.KeyIdx = dedupKeys(tmp.Words)
+	}
+	if uint64(len(tmp.CMS)) != tmp.L || uint64(len(tmp.Counts)) != tmp.L || uint64(len(tmp.KeyIdx)) != tmp.L || len(tmp.Keys) == 0 {
+		return errMalformed
+	}
+	if tmp.B != 0 && tmp.L > math.MaxInt/tmp.B {
+		return errMalformed
+	}
+	for i := range tmp.CMS {
+		if uint64(len(tmp.CMS[i])) != tmp.B || uint64(len(tmp.Counts[i])) != tmp.B || uint64(len(tmp.KeyIdx[i])) != tmp.B {
+			return errMalformed
+		}
+	}
+
+	var (
+		keys           = make([]K, len(tmp.Keys))
+		strs, isString = any(keys).([]string)
+	)
+	if !isString && codec == nil {
+		return errNoCodec
+	}
+	for i, key := range tmp.Keys {
+		if codec == nil {
+			strs[i] = key
+			continue
+		}
+		k, err := codec.DecodeKey([]byte(key))
+		if err != nil {
+			return err
+		}
+		keys[i] = k
 	}
+
+	var (
+		buckets = make([]bucket, tmp.L*tmp.B)
+		in      = newInterner[K]()
+		idxs    = make([]uint32, len(keys))
+		hs      = make([]uint64, len(keys))
+	)
+	for i := range tmp.CMS {
+		row := buckets[uint64(i)*tmp.B : uint64(i+1)*tmp.B]
+		for j := range row {
+			idx := tmp.KeyIdx[i][j]
+			if idx >= uint32(len(keys)) {
+				return errMalformed
+			}
+			row[j].cms = tmp.CMS[i][j]
+			row[j].count = tmp.Counts[i][j]
+			if idx == 0 {
+				continue
+			}
+			if idxs[idx] == 0 {
+				hs[idx] = hasher.Hash(keys[idx])
+				idxs[idx] = in.share(keys[idx], hs[idx])
+			} else {
+				in.ref(idxs[idx])
+			}
+			row[j].key = idxs[idx]
+			row[j].tag = fingerprint(hs[idx])
+		}
+	}
+
+	res := GenericSketch[K]{
+		l:       tmp.L,
+		b:       tmp.B,
+		k:       tmp.K,
+		buckets: buckets,
+		keys:    in,
+		hasher:  hasher,
+
+		conservative: tmp.Conservative,
+	}
+	if tmp.Total != nil {
+		res.total = *tmp.Total
+	} else if !res.conservative {
+		// Sketches marshalled before the total was persisted have it as the sum of
+		// any of their rows
+		for j := uint64(0); j < res.b && res.l > 0; j++ {
+			res.total += res.buckets[j].cms
+		}
+	}
+	if !res.narrow(width) {
+		return errMalformed
+	}
+	*sk = res
 	return nil
 }
+
+// dedupKeys converts the keys of every bucket into a list of distinct keys,
+// the first of which is the empty key, and each bucket's index into it.
+func dedupKeys(words [][]string) ([]string, [][]uint32) {
+	var (
+		keys  = []string{""}
+		index = map[string]uint32{"": 0}
+		idxs  = make([][]uint32, len(words))
+	)
+	for i := range words {
+		idxs[i] = make([]uint32, len(words[i]))
+		for j, word := range words[i] {
+			idx, ok := index[word]
+			if !ok {
+				idx = uint32(len(keys))
+				index[word] = idx
+				keys = append(keys, word)
+			}
+			idxs[i][j] = idx
+		}
+	}
+	return keys, idxs
+}
+
+// customHash is persisted as the hash function of sketches whose hasher is not
+// an IdentifiedHasher.
+const customHash = "custom"
+
+// unmarshalHasher returns the hasher for a sketch marshalled with the hash
+// function fn and seed, given the hasher of the sketch being unmarshalled into.
+func unmarshalHasher[K comparable](hasher Hasher[K], fn HashFunc, seed uint64) (Hasher[K], error) {
+	switch fn {
+	case "":
+		// Sketches marshalled before the hasher was persisted used the default
+		fn, seed = Metro, DefaultSeed
+	case customHash:
+		if hasher == nil {
+			return nil, errNoHasher
+		}
+		return hasher, nil
+	}
+
+	if h, err := newStringHasher(fn, seed); err == nil {
+		if h, ok := h.(Hasher[K]); ok {
+			return h, nil
+		}
+	}
+
+	if hasher == nil {
+		return nil, errNoHasher
+	}
+	if h, ok := hasher.(IdentifiedHasher); !ok {
+		return nil, errHasherMismatch
+	} else if hfn, hseed := h.HashID(); hfn != fn || hseed != seed {
+		return nil, errHasherMismatch
+	}
+	return hasher, nil
+}
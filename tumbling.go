@@ -0,0 +1,148 @@
+package topkapi
+
+import (
+	"errors"
+	"time"
+)
+
+// TumblingWindow is the summary of a window emitted by a TumblingSketch.
+type TumblingWindow struct {
+	Start, End   time.Time
+	Inserts      uint64 // number of calls to Insert in the window
+	Total        uint64 // total count inserted in the window
+	HeavyHitters []LocalHeavyHitter
+}
+
+// TumblingSketch summarizes a stream in consecutive, non-overlapping windows.
+// Every given number of inserts, given interval or both, whichever comes first,
+// the heavy hitters of the window are handed to a callback and the sketch is
+// reset for the next window.
+//
+// The heavy hitters are those reported by Result with the threshold set by
+// WithEmitThreshold, or by TopK with the k set by WithEmitTopK. Windows are
+// only emitted from the methods of the sketch, which are not safe for
+// concurrent use. When inserts may pause, call Tick periodically to emit
+// windows whose interval has elapsed in the meantime.
+type TumblingSketch struct {
+	sk       *Sketch
+	emit     func(TumblingWindow)
+	every    uint64
+	interval time.Duration
+	report   func(*Sketch) []LocalHeavyHitter
+	clock    func() time.Time
+
+	start   time.Time
+	inserts uint64
+}
+
+// NewTumbling creates a TumblingSketch which hands each window to emit,
+// configured by opts. One of WithEmitEvery and WithEmitInterval is required.
+// See NewWithOptions for the configuration of the sketch.
+func NewTumbling(emit func(TumblingWindow), opts ...Option) (*TumblingSketch, error) {
+	o, err := newOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := o.only(clockOption | emitOptions); err != nil {
+		return nil, err
+	}
+	sk, err := o.sketch()
+	if err != nil {
+		return nil, err
+	}
+	return newTumblingSketch(sk, emit, o)
+}
+
+func newTumblingSketch(sk *Sketch, emit func(TumblingWindow), o *options) (*TumblingSketch, error) {
+	switch {
+	case emit == nil:
+		return nil, errors.New("topkapi: emit must not be nil")
+	case o.emitEvery == 0 && o.emitInterval == 0:
+		return nil, errors.New("topkapi: one of emit every or emit interval is required")
+	}
+
+	t := &TumblingSketch{
+		sk:       sk,
+		emit:     emit,
+		every:    o.emitEvery,
+		interval: o.emitInterval,
+		clock:    o.clock,
+	}
+	if k := o.emitTopK; k > 0 {
+		t.report = func(sk *Sketch) []LocalHeavyHitter { return sk.TopK(k) }
+	} else {
+		threshold := o.emitThreshold
+		t.report = func(sk *Sketch) []LocalHeavyHitter { return sk.Result(threshold) }
+	}
+	t.start = t.clock()
+	return t, nil
+}
+
+// EmitTo returns a callback for a TumblingSketch that sends each window to ch.
+func EmitTo(ch chan<- TumblingWindow) func(TumblingWindow) {
+	return func(w TumblingWindow) {
+		ch <- w
+	}
+}
+
+// Insert adds count occurrences of key to the current window. Before that,
+// the previous window is emitted if its interval has elapsed, and afterwards
+// the current one is if it has reached its number of inserts.
+func (t *TumblingSketch) Insert(key string, count uint64) {
+	t.Tick()
+	t.sk.Insert(key, count)
+	t.inserted()
+}
+
+// InsertBytes is like Insert, but takes the key as a byte slice.
+func (t *TumblingSketch) InsertBytes(key []byte, count uint64) {
+	t.Tick()
+	t.sk.InsertBytes(key, count)
+	t.inserted()
+}
+
+// inserted counts an insert, and emits the window if it is full.
+func (t *TumblingSketch) inserted() {
+	if t.inserts++; t.inserts == t.every {
+		t.flush(t.clock())
+	}
+}
+
+// Tick emits the current window if its interval has elapsed. The next window
+// starts at the beginning of the interval the clock is in, skipping intervals
+// without inserts.
+func (t *TumblingSketch) Tick() {
+	if t.interval == 0 {
+		return
+	}
+	now := t.clock()
+	if elapsed := now.Sub(t.start); elapsed >= t.interval {
+		next := t.start.Add(elapsed / t.interval * t.interval)
+		t.flush(t.start.Add(t.interval))
+		t.start = next
+	}
+}
+
+// Flush emits the current window, unless it is empty, and starts a new one.
+// It is meant for the end of a stream, whose last window is usually not
+// complete.
+func (t *TumblingSketch) Flush() {
+	t.flush(t.clock())
+}
+
+// flush emits the current window, ending at end, unless it is empty, and
+// starts a new one at end.
+func (t *TumblingSketch) flush(end time.Time) {
+	if t.inserts > 0 {
+		t.emit(TumblingWindow{
+			Start:        t.start,
+			End:          end,
+			Inserts:      t.inserts,
+			Total:        t.sk.Total(),
+			HeavyHitters: t.report(t.sk),
+		})
+	}
+	t.sk.Reset()
+	t.start = end
+	t.inserts = 0
+}
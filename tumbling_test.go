@@ -0,0 +1,103 @@
+package topkapi
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReset(t *testing.T) {
+	words := loadWords()
+
+	sketch, _ := NewWithOptions(WithDimensions(4, 1000), WithCounterWidth(16))
+	sketch.InsertMany(words)
+	sketch.Insert("big", 1<<20)
+	buckets, keys := &sketch.buckets32[0], &sketch.keys.entries[0]
+
+	sketch.Reset()
+	assert.Zero(t, sketch.Total())
+	assert.Zero(t, sketch.keys.len())
+	assert.Empty(t, sketch.ResultWithVotes(0, 1))
+	assert.Equal(t, 32, sketch.CounterWidth())
+	for _, c := range cmsOf(sketch) {
+		assert.Zero(t, c)
+	}
+
+	// A reset sketch reuses its memory and behaves like a new one
+	fresh, _ := NewWithOptions(WithDimensions(4, 1000))
+	sketch.InsertMany(words[:10000])
+	fresh.InsertMany(words[:10000])
+	assertSketchesEqual(t, &fresh.GenericSketch, &sketch.GenericSketch)
+	assert.Same(t, buckets, &sketch.buckets32[0])
+	assert.Same(t, keys, &sketch.keys.entries[0])
+}
+
+func TestTumblingSketch(t *testing.T) {
+	words := loadWords()[:10000]
+
+	_, err := NewTumbling(func(TumblingWindow) {}, WithDimensions(4, 1000))
+	assert.Error(t, err)
+
+	// Windows of a number of inserts, sent to a channel
+	ch := make(chan TumblingWindow, 10)
+	tumbling, err := NewTumbling(EmitTo(ch), WithDimensions(4, 1000), WithEmitEvery(2500), WithEmitTopK(5))
+	assert.NoError(t, err)
+	for _, w := range words {
+		tumbling.Insert(w, 1)
+	}
+	tumbling.InsertBytes([]byte("foo"), 3)
+	tumbling.Flush()
+	tumbling.Flush()
+	close(ch)
+
+	var windows []TumblingWindow
+	for w := range ch {
+		windows = append(windows, w)
+	}
+	if assert.Len(t, windows, 5) {
+		for i, w := range windows[:4] {
+			sketch, _ := NewWithOptions(WithDimensions(4, 1000))
+			sketch.InsertMany(words[i*2500 : (i+1)*2500])
+			assert.Equal(t, uint64(2500), w.Inserts)
+			assert.Equal(t, uint64(2500), w.Total)
+			assert.Equal(t, sketch.TopK(5), w.HeavyHitters)
+		}
+		assert.Equal(t, TumblingWindow{
+			Start:        windows[3].End,
+			End:          windows[4].End,
+			Inserts:      1,
+			Total:        3,
+			HeavyHitters: []LocalHeavyHitter{{Key: "foo", Count: 3, Lower: 3, Votes: 4}},
+		}, windows[4])
+	}
+
+	// Windows of an interval, skipping intervals without inserts
+	var (
+		now     = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+		emitted []TumblingWindow
+	)
+	tumbling, err = NewTumbling(func(w TumblingWindow) { emitted = append(emitted, w) },
+		WithDimensions(4, 1000), WithEmitInterval(time.Minute), WithEmitThreshold(100), WithClock(func() time.Time { return now }))
+	assert.NoError(t, err)
+	start := now
+	for i := 0; i < 90; i++ {
+		tumbling.Insert("foo", 10)
+		now = now.Add(time.Second)
+	}
+	now = now.Add(3 * time.Minute)
+	tumbling.Tick()
+	tumbling.Insert("bar", 1)
+	tumbling.Tick()
+
+	if assert.Len(t, emitted, 2) {
+		assert.Equal(t, start, emitted[0].Start)
+		assert.Equal(t, start.Add(time.Minute), emitted[0].End)
+		assert.Equal(t, uint64(60), emitted[0].Inserts)
+		assert.Equal(t, "foo", emitted[0].HeavyHitters[0].Key)
+		assert.Equal(t, start.Add(time.Minute), emitted[1].Start)
+		assert.Equal(t, uint64(300), emitted[1].Total)
+	}
+	assert.Equal(t, start.Add(4*time.Minute), tumbling.start)
+	assert.Equal(t, uint64(1), tumbling.sk.Total())
+}
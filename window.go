@@ -0,0 +1,192 @@
+package topkapi
+
+import (
+	"errors"
+	"time"
+)
+
+// WindowedSketch summarizes a sliding window of a stream, such as the last
+// hour. The window is made of a ring of sketches, each holding the occurrences
+// of one interval of the given resolution, such as a minute. As the clock
+// advances to the next interval, the sketch of the oldest one is reset and
+// reused.
+//
+// The window as a whole is kept in a merged sketch which is updated along with
+// the ring: inserts go into both, and the sketch of an interval that drops out
+// of the window is subtracted from it, see Sketch.Subtract. Queries over the
+// whole window thus don't need to merge the ring, while shorter trailing
+// windows can be queried at the resolution of the ring with Window.
+//
+// The window includes the current interval, which is only partially elapsed.
+// A WindowedSketch is not safe for concurrent use, and cannot be created with
+// conservative updates, which cannot be subtracted.
+type WindowedSketch struct {
+	slots      []*Sketch // sketch of interval i at index i%len(slots)
+	resolution time.Duration
+	clock      func() time.Time
+	head       int64   // current interval
+	merged     *Sketch // sum of all slots
+}
+
+// NewWindowed creates a WindowedSketch over the given number of intervals of
+// the given resolution, whose sketches are configured by opts. See
+// NewWithOptions for details.
+func NewWindowed(slots int, resolution time.Duration, opts ...Option) (*WindowedSketch, error) {
+	o, err := newOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+	if err := o.only(clockOption); err != nil {
+		return nil, err
+	}
+	sk, err := o.sketch()
+	if err != nil {
+		return nil, err
+	}
+	return newWindowedSketch(sk, slots, resolution, o.clock)
+}
+
+// newWindowedSketch creates a WindowedSketch whose sketches are like sk.
+func newWindowedSketch(sk *Sketch, slots int, resolution time.Duration, clock func() time.Time) (*WindowedSketch, error) {
+	switch {
+	case slots < 1:
+		return nil, errors.New("topkapi: a window needs at least one slot")
+	case resolution <= 0:
+		return nil, errors.New("topkapi: resolution must be positive")
+	case sk.conservative:
+		return nil, errors.New("topkapi: WindowedSketch does not support conservative updates")
+	}
+
+	w := &WindowedSketch{
+		slots:      make([]*Sketch, slots),
+		resolution: resolution,
+		clock:      clock,
+		merged:     sk,
+	}
+	for i := range w.slots {
+		w.slots[i] = newSketchLike(sk)
+	}
+	w.head = w.interval(w.clock())
+	return w, nil
+}
+
+// interval returns the number of the interval t falls into.
+func (w *WindowedSketch) interval(t time.Time) int64 {
+	return t.UnixNano() / int64(w.resolution)
+}
+
+// advance moves the window to the current interval, clearing the slots of
+// the intervals that drop out of it. A clock going backwards leaves the window
+// where it is.
+func (w *WindowedSketch) advance() {
+	now := w.interval(w.clock())
+	if now <= w.head {
+		return
+	}
+
+	if now-w.head >= int64(len(w.slots)) {
+		for _, s := range w.slots {
+			s.Reset()
+		}
+		w.merged.Reset()
+	} else {
+		for i := w.head + 1; i <= now; i++ {
+			s := w.slot(i)
+			_ = w.merged.Subtract(s)
+			s.Reset()
+		}
+	}
+	w.head = now
+}
+
+// current returns the sketch of the current interval.
+func (w *WindowedSketch) current() *Sketch {
+	w.advance()
+	return w.slot(w.head)
+}
+
+// slot returns the sketch of interval i.
+func (w *WindowedSketch) slot(i int64) *Sketch {
+	n := int64(len(w.slots))
+	return w.slots[(i%n+n)%n]
+}
+
+// Slots returns the number of intervals of the window and their duration.
+func (w *WindowedSketch) Slots() (slots int, resolution time.Duration) {
+	return len(w.slots), w.resolution
+}
+
+// Epsilon is the approximate error range factor.
+func (w *WindowedSketch) Epsilon() float64 {
+	return w.merged.Epsilon()
+}
+
+// Delta is the probability for a measurement to be outside the epsilon range
+func (w *WindowedSketch) Delta() float64 {
+	return w.merged.Delta()
+}
+
+// Insert adds count occurrences of key to the current interval.
+func (w *WindowedSketch) Insert(key string, count uint64) {
+	w.current().Insert(key, count)
+	w.merged.Insert(key, count)
+}
+
+// InsertBytes is like Insert, but takes the key as a byte slice.
+func (w *WindowedSketch) InsertBytes(key []byte, count uint64) {
+	w.current().InsertBytes(key, count)
+	w.merged.InsertBytes(key, count)
+}
+
+// Window returns a sketch of the given number of trailing intervals, which
+// is capped at the size of the window. For the whole window, this is the
+// merged sketch maintained by w, which must not be modified and is only valid
+// until the next call to a method of w. Shorter windows are merged from the
+// ring on each call.
+func (w *WindowedSketch) Window(slots int) *Sketch {
+	w.advance()
+	if slots >= len(w.slots) {
+		return w.merged
+	}
+
+	res := newSketchLike(w.merged)
+	for i := 0; i < slots; i++ {
+		_ = res.Merge(w.slot(w.head - int64(i)))
+	}
+	return res
+}
+
+// Estimate is like Sketch.Estimate, over the whole window.
+func (w *WindowedSketch) Estimate(key string) (uint64, bool) {
+	return w.Window(len(w.slots)).Estimate(key)
+}
+
+// Total is like Sketch.Total, over the whole window.
+func (w *WindowedSketch) Total() uint64 {
+	return w.Window(len(w.slots)).Total()
+}
+
+// Result is like Sketch.Result, over the whole window.
+func (w *WindowedSketch) Result(threshold uint64) []LocalHeavyHitter {
+	return w.Window(len(w.slots)).Result(threshold)
+}
+
+// ResultFraction is like Sketch.ResultFraction, over the whole window.
+func (w *WindowedSketch) ResultFraction(phi float64) []LocalHeavyHitter {
+	return w.Window(len(w.slots)).ResultFraction(phi)
+}
+
+// ResultWithVotes is like Sketch.ResultWithVotes, over the whole window.
+func (w *WindowedSketch) ResultWithVotes(threshold uint64, minVotes int) []LocalHeavyHitter {
+	return w.Window(len(w.slots)).ResultWithVotes(threshold, minVotes)
+}
+
+// TopK is like Sketch.TopK, over the whole window.
+func (w *WindowedSketch) TopK(k int) []LocalHeavyHitter {
+	return w.Window(len(w.slots)).TopK(k)
+}
+
+// Top is like Sketch.Top, over the whole window.
+func (w *WindowedSketch) Top() []LocalHeavyHitter {
+	return w.Window(len(w.slots)).Top()
+}
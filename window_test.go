@@ -0,0 +1,85 @@
+package topkapi
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWindowedSketch(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+
+	_, err := NewWindowed(0, time.Minute, WithDimensions(4, 1000))
+	assert.Error(t, err)
+	_, err = NewWindowed(60, time.Minute, WithDimensions(4, 1000), WithConservativeUpdate())
+	assert.Error(t, err)
+	_, err = NewWindowed(60, time.Minute, WithDimensions(4, 1000), WithEmitInterval(time.Hour))
+	assert.Error(t, err)
+
+	w, err := NewWindowed(60, time.Minute, WithDimensions(4, 4000), WithCounterWidth(16), WithClock(clock))
+	assert.NoError(t, err)
+
+	// Every minute a different key is the heaviest, on top of a common stream
+	words := zipfWords(loadWords(), 200*120)
+	minutes := make([]*Sketch, 0, 120)
+	for m := 0; m < 120; m++ {
+		sk, _ := NewWithOptions(WithDimensions(4, 4000))
+		for _, word := range words[m*200 : (m+1)*200] {
+			w.Insert(word, 1)
+			sk.Insert(word, 1)
+		}
+		hot := []byte(fmt.Sprintf("hot%03d", m))
+		w.InsertBytes(hot, 2000+50*uint64(m))
+		sk.InsertBytes(hot, 2000+50*uint64(m))
+		minutes = append(minutes, sk)
+
+		// The merged view matches merging the sketches of the last hour
+		if m%17 == 0 || m == 119 {
+			exact, _ := NewWithOptions(WithDimensions(4, 4000))
+			from := 0
+			if m >= 60 {
+				from = m - 59
+			}
+			for _, sk := range minutes[from:] {
+				assert.NoError(t, exact.Merge(sk))
+			}
+			assert.Equal(t, exact.Total(), w.Total())
+			assert.Equal(t, cmsOf(exact), cmsOf(w.Window(60)))
+			assert.Equal(t, resultToMap(exact.ResultWithVotes(1000, 1)), resultToMap(w.ResultWithVotes(1000, 1)))
+		}
+		now = now.Add(time.Minute)
+	}
+	now = now.Add(-time.Second)
+
+	// The hot keys of the last hour are reported, newest first
+	result := w.Result(4900)
+	if assert.Len(t, result, 60) {
+		assert.Equal(t, "hot119", result[0].Key)
+		assert.Equal(t, "hot060", result[59].Key)
+	}
+	top := w.TopK(3)
+	assert.Equal(t, "hot119", top[0].Key)
+	assert.Equal(t, "hot118", top[1].Key)
+	count, _ := w.Estimate("hot059")
+	assert.Less(t, count, uint64(100))
+
+	// Trailing windows at the resolution of the ring
+	assert.Equal(t, "hot119", w.Window(1).TopK(1)[0].Key)
+	assert.Len(t, w.Window(5).Result(4900), 5)
+	assert.Len(t, w.Window(100).Result(4900), 60)
+	assert.Equal(t, uint64(0), w.Window(0).Total())
+
+	// A clock going backwards doesn't move the window
+	now = now.Add(-time.Hour)
+	assert.Len(t, w.Result(4900), 60)
+
+	// Once the whole window has elapsed, nothing is left
+	now = now.Add(3 * time.Hour)
+	assert.Zero(t, w.Total())
+	assert.Empty(t, w.ResultWithVotes(0, 1))
+	w.Insert("foo", 1)
+	assert.Equal(t, "foo", w.TopK(1)[0].Key)
+}